@@ -47,6 +47,9 @@ type YamlConfig struct {
 	ResponseHeaderTimeout metrics.Interval `yaml:"ResponseHeaderTimeout"`
 	// Max number of incoming requests to process in parallel
 	MaxConcurrentRequests int32 `yaml:"MaxConcurrentRequests" validate:"min=1"`
+	// Max number of requests in progress to single backend, requests over
+	// limit fail at once. Default 0 (no limit)
+	MaxConcurrentRequestsPerBackend int `yaml:"MaxConcurrentRequestsPerBackend,omitempty" validate:"min=0"`
 
 	Clusters map[string]shardingconfig.ClusterConfig `yaml:"Clusters,omitempty"`
 	Regions  map[string]shardingconfig.RegionConfig  `yaml:"Regions,omitempty"`
@@ -58,13 +61,37 @@ type YamlConfig struct {
 
 	// Backend in maintenance mode. Akubra will not send data there
 	MaintainedBackends []shardingconfig.YAMLUrl `yaml:"MaintainedBackends,omitempty"`
+	// Stop sending requests to failing backends
+	CircuitBreaker shardingconfig.CircuitBreakerConfig `yaml:"CircuitBreaker,omitempty"`
+	// Probe backends periodically
+	BackendHealthCheck shardingconfig.HealthCheckConfig `yaml:"BackendHealthCheck,omitempty"`
+	// Repeat slow GET requests on second backend
+	HedgedReads shardingconfig.HedgedReadsConfig `yaml:"HedgedReads,omitempty"`
+	// Retry idempotent requests failed on backend
+	BackendRetries shardingconfig.RetryConfig `yaml:"BackendRetries,omitempty"`
 
 	// List request methods to be logged in synclog in case of backend failure
 	SyncLogMethods []shardingconfig.SyncLogMethod `yaml:"SyncLogMethods,omitempty"`
-	Logging        logconfig.LoggingConfig        `yaml:"Logging,omitempty"`
-	Metrics        metrics.Config                 `yaml:"Metrics,omitempty"`
+	// Verify that backends stored the same content
+	ReplicaChecksums shardingconfig.ReplicaChecksumsConfig `yaml:"ReplicaChecksums,omitempty"`
+	Logging          logconfig.LoggingConfig               `yaml:"Logging,omitempty"`
+	Metrics          metrics.Config                        `yaml:"Metrics,omitempty"`
 	// Should we keep alive connections with backend servers
 	DisableKeepAlives bool `yaml:"DisableKeepAlives"`
+	// TLS settings of connections to https:// backends
+	BackendTLS shardingconfig.TLSConfig `yaml:"BackendTLS,omitempty"`
+	// Stream request bodies to backends instead of buffering them
+	BodyStreaming shardingconfig.BodyStreamingConfig `yaml:"BodyStreaming,omitempty"`
+	// Buffer large request bodies in temporary files instead of memory
+	BodySpill shardingconfig.BodySpillConfig `yaml:"BodySpill,omitempty"`
+	// Queue of writes replicated to backends in background
+	AsyncReplication shardingconfig.AsyncReplicationConfig `yaml:"AsyncReplication,omitempty"`
+	// Coordinate multipart uploads across backends
+	MultipartUploads shardingconfig.MultipartUploadsConfig `yaml:"MultipartUploads,omitempty"`
+	// Verify signatures of client requests
+	ClientAuth shardingconfig.ClientAuthConfig `yaml:"ClientAuth,omitempty"`
+	// Authorize client requests with per access key policies
+	AccessPolicies shardingconfig.AccessPoliciesConfig `yaml:"AccessPolicies,omitempty"`
 }
 
 // Config contains processed YamlConfig data
@@ -173,12 +200,14 @@ func setupSyncLogThread(conf *Config, methods []interface{}) {
 func ValidateConf(conf YamlConfig, enableLogicalValidator bool) (bool, map[string][]error) {
 	validator.SetValidationFunc("NoEmptyValuesSlice", NoEmptyValuesInSliceValidator)
 	validator.SetValidationFunc("UniqueValuesSlice", UniqueValuesInSliceValidator)
+	validator.SetValidationFunc("ErrorRate", ErrorRateValidator)
 	valid, validationErrors := validator.Validate(conf)
 	if valid && enableLogicalValidator {
-		var validListenPorts bool
+		var validListenPorts, validBodySpill bool
 		conf.RegionsEntryLogicalValidator(&valid, &validationErrors)
 		conf.ListenPortsLogicalValidator(&validListenPorts, &validationErrors)
-		valid = valid && validListenPorts
+		conf.BodySpillLogicalValidator(&validBodySpill, &validationErrors)
+		valid = valid && validListenPorts && validBodySpill
 	}
 	for propertyName, validatorMessage := range validationErrors {
 		log.Printf("[ ERROR ] YAML config validation -> propertyName: '%s', validatorMessage: '%s'\n", propertyName, validatorMessage)
@@ -60,6 +60,23 @@ func UniqueValuesInSliceValidator(v interface{}, param string) error {
 	return nil
 }
 
+// ErrorRateValidator accepts rates in (0-1] range, omitted rate is valid
+func ErrorRateValidator(v interface{}, param string) error {
+	switch rate := v.(type) {
+	case *float64:
+		if rate == nil {
+			return nil
+		}
+		return ErrorRateValidator(*rate, param)
+	case float64:
+		if rate <= 0 || rate > 1 {
+			return fmt.Errorf("ErrorRateValidator: %v is out of (0-1] range", rate)
+		}
+		return nil
+	}
+	return errors.New("ErrorRateValidator: validates only float64 kind")
+}
+
 //RegionsEntryLogicalValidator checks the correctness of "Regions" part of configuration file
 func (c *YamlConfig) RegionsEntryLogicalValidator(valid *bool, validationErrors *map[string][]error) {
 	errList := make([]error, 0)
@@ -70,14 +87,28 @@ func (c *YamlConfig) RegionsEntryLogicalValidator(valid *bool, validationErrors
 			if len(clusterDef.Clusters) == 0 {
 				errList = append(errList, fmt.Errorf("No clusters defined for region \"%s\"", regionName))
 			}
+			regionBackends := 0
 			for _, singleCluster := range clusterDef.Clusters {
-				_, exists := c.Clusters[singleCluster.Cluster]
+				clusterConf, exists := c.Clusters[singleCluster.Cluster]
 				if !exists {
 					errList = append(errList, fmt.Errorf("Cluster \"%s\" is region \"%s\" is not defined", regionName, singleCluster.Cluster))
 				}
 				if singleCluster.Weight < 0 || singleCluster.Weight > 1 {
 					errList = append(errList, fmt.Errorf("Weight for cluster \"%s\" in region \"%s\" is not valid", singleCluster.Cluster, regionName))
 				}
+				if clusterConf.WriteQuorum < 0 || clusterConf.WriteQuorum > len(clusterConf.Backends) {
+					errList = append(errList, fmt.Errorf("WriteQuorum for cluster \"%s\" is not valid", singleCluster.Cluster))
+				}
+				if clusterConf.AsyncReplication && !c.AsyncReplication.Enabled {
+					errList = append(errList, fmt.Errorf("AsyncReplication for cluster \"%s\" requires AsyncReplication to be enabled", singleCluster.Cluster))
+				}
+				if clusterConf.AsyncReplication && clusterConf.WriteQuorum > 0 {
+					errList = append(errList, fmt.Errorf("AsyncReplication for cluster \"%s\" can't be used with WriteQuorum", singleCluster.Cluster))
+				}
+				regionBackends += len(clusterConf.Backends)
+			}
+			if clusterDef.WriteQuorum < 0 || clusterDef.WriteQuorum > regionBackends {
+				errList = append(errList, fmt.Errorf("WriteQuorum for region \"%s\" is not valid", regionName))
 			}
 			if len(clusterDef.Domains) == 0 {
 				errList = append(errList, fmt.Errorf("No domain defined for region \"%s\"", regionName))
@@ -110,6 +141,19 @@ func (c *YamlConfig) ListenPortsLogicalValidator(valid *bool, validationErrors *
 	*validationErrors = mergeErrors(*validationErrors, errorsList)
 }
 
+// BodySpillLogicalValidator makes sure that body spill has its own directory,
+// files found there are removed on startup
+func (c *YamlConfig) BodySpillLogicalValidator(valid *bool, validationErrors *map[string][]error) {
+	errorsList := make(map[string][]error)
+	if c.BodySpill.Enabled && c.BodySpill.Dir == "" {
+		*valid = false
+		errorsList["BodySpillLogicalValidator"] = []error{errors.New("BodySpill requires Dir")}
+	} else {
+		*valid = true
+	}
+	*validationErrors = mergeErrors(*validationErrors, errorsList)
+}
+
 func mergeErrors(maps ...map[string][]error) (output map[string][]error) {
 	size := len(maps)
 	if size == 0 {
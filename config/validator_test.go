@@ -94,6 +94,24 @@ func TestShouldNotPassListenPortsLogicalValidatorWhenPortsAreEqual(t *testing.T)
 	assert.False(t, valid, "Should be false")
 }
 
+func TestShouldNotPassBodySpillLogicalValidatorWithoutDir(t *testing.T) {
+	valid := true
+	validationErrors := make(map[string][]error)
+	yamlConfig := YamlConfig{}
+	yamlConfig.BodySpill.Enabled = true
+	yamlConfig.BodySpillLogicalValidator(&valid, &validationErrors)
+
+	assert.Len(t, validationErrors, 1, "Should be one error")
+	assert.False(t, valid, "Should be false")
+
+	yamlConfig.BodySpill.Dir = "/var/tmp/akubra"
+	validationErrors = make(map[string][]error)
+	yamlConfig.BodySpillLogicalValidator(&valid, &validationErrors)
+
+	assert.Len(t, validationErrors, 0, "Should not be errors")
+	assert.True(t, valid, "Should be true")
+}
+
 func TestShouldPassHeaderContentLengthValidator(t *testing.T) {
 	var bodySizeLimit int64 = 128
 	request := httptest.NewRequest("POST", "http://somepath", nil)
@@ -247,3 +265,68 @@ func TestValidatorShouldFailWithMissingClusterDefinition(t *testing.T) {
 		errors.New("No clusters defined for region \"testregion\""),
 		validationErrors["RegionsEntryLogicalValidator"][0])
 }
+
+func TestValidatorShouldFailWithWriteQuorumExceedingBackends(t *testing.T) {
+	multiClusterConfig := &shardingconfig.MultiClusterConfig{
+		Cluster: "cluster1test",
+		Weight:  1,
+	}
+	regionConfig := &shardingconfig.RegionConfig{
+		Clusters:    []shardingconfig.MultiClusterConfig{*multiClusterConfig},
+		Domains:     []string{"domain.dc"},
+		WriteQuorum: 2,
+	}
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	regions := map[string]shardingconfig.RegionConfig{"testregion": *regionConfig}
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", regions)
+	valid := true
+	validationErrors := make(map[string][]error)
+	yamlConfig.RegionsEntryLogicalValidator(&valid, &validationErrors)
+	assert.False(t, valid)
+	assert.Equal(
+		t,
+		errors.New("WriteQuorum for region \"testregion\" is not valid"),
+		validationErrors["RegionsEntryLogicalValidator"][0])
+}
+
+func TestValidatorShouldFailWithAsyncReplicationQueueDisabled(t *testing.T) {
+	multiClusterConfig := &shardingconfig.MultiClusterConfig{
+		Cluster: "cluster1test",
+		Weight:  1,
+	}
+	regionConfig := &shardingconfig.RegionConfig{
+		Clusters: []shardingconfig.MultiClusterConfig{*multiClusterConfig},
+		Domains:  []string{"domain.dc"},
+	}
+	var size shardingconfig.HumanSizeUnits
+	size.SizeInBytes = 2048
+	regions := map[string]shardingconfig.RegionConfig{"testregion": *regionConfig}
+	yamlConfig := PrepareYamlConfig(size, 31, 45, "127.0.0.1:81", "127.0.0.1:1234", "127.0.0.1:1235", regions)
+	clusterConfig := yamlConfig.Clusters["cluster1test"]
+	clusterConfig.AsyncReplication = true
+	yamlConfig.Clusters["cluster1test"] = clusterConfig
+	valid := true
+	validationErrors := make(map[string][]error)
+	yamlConfig.RegionsEntryLogicalValidator(&valid, &validationErrors)
+	assert.False(t, valid)
+	assert.Equal(
+		t,
+		errors.New("AsyncReplication for cluster \"cluster1test\" requires AsyncReplication to be enabled"),
+		validationErrors["RegionsEntryLogicalValidator"][0])
+
+	yamlConfig.AsyncReplication.Enabled = true
+	validationErrors = make(map[string][]error)
+	yamlConfig.RegionsEntryLogicalValidator(&valid, &validationErrors)
+	assert.True(t, valid)
+}
+
+func TestErrorRateValidator(t *testing.T) {
+	rate := func(r float64) *float64 { return &r }
+	assert.NoError(t, ErrorRateValidator((*float64)(nil), ""))
+	assert.NoError(t, ErrorRateValidator(rate(0.5), ""))
+	assert.NoError(t, ErrorRateValidator(1.0, ""))
+	assert.Error(t, ErrorRateValidator(rate(0), ""))
+	assert.Error(t, ErrorRateValidator(0.0, ""))
+	assert.Error(t, ErrorRateValidator(1.5, ""))
+}
@@ -0,0 +1,141 @@
+package httphandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+)
+
+// ErrReplicaChecksumMismatch is returned to client if backends returned
+// different checksums of stored object and verification is strict for bucket
+var ErrReplicaChecksumMismatch = errors.New("Replicas checksums mismatch")
+
+const amzChecksumHeaderPrefix = "X-Amz-Checksum-"
+
+// checksumVerifier compares checksums returned by backends on PUT requests
+type checksumVerifier struct {
+	strictBuckets map[string]bool
+}
+
+func newChecksumVerifier(conf config.Config) *checksumVerifier {
+	if !conf.ReplicaChecksums.Enabled {
+		return nil
+	}
+	strictBuckets := make(map[string]bool, len(conf.ReplicaChecksums.StrictBuckets))
+	for _, bucket := range conf.ReplicaChecksums.StrictBuckets {
+		strictBuckets[bucket] = true
+	}
+	return &checksumVerifier{strictBuckets: strictBuckets}
+}
+
+func (cv *checksumVerifier) enabled(req *http.Request) bool {
+	return cv != nil && req.Method == http.MethodPut
+}
+
+// strict reports if client should get an error on checksum mismatch,
+// response has to be held until all backends respond then
+func (cv *checksumVerifier) strict(req *http.Request) bool {
+	return cv.enabled(req) && cv.strictBuckets[bucketName(req.URL.Path)]
+}
+
+func bucketName(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
+
+// replicaChecksums returns ETag and x-amz-checksum-* response headers
+func replicaChecksums(resp *http.Response) map[string]string {
+	checksums := make(map[string]string)
+	for name := range resp.Header {
+		if name == "Etag" || strings.HasPrefix(name, amzChecksumHeaderPrefix) {
+			checksums[name] = resp.Header.Get(name)
+		}
+	}
+	return checksums
+}
+
+// checksumsDiff describes headers with different values, both missing
+// and extra headers are ignored, as not all backends compute all checksums
+func checksumsDiff(expected, actual map[string]string) string {
+	diffs := []string{}
+	for name, value := range expected {
+		actualValue, ok := actual[name]
+		if ok && actualValue != value {
+			diffs = append(diffs, fmt.Sprintf("%s %q != %q", name, value, actualValue))
+		}
+	}
+	sort.Strings(diffs)
+	return strings.Join(diffs, ", ")
+}
+
+// replicaResponse holds successful response with its checksums, which are
+// copied before response is passed further and its headers may change
+type replicaResponse struct {
+	tup       transport.ReqResErrTuple
+	checksums map[string]string
+}
+
+func (cv *checksumVerifier) collect(r transport.ReqResErrTuple) replicaResponse {
+	if !cv.enabled(r.Req) {
+		return replicaResponse{tup: r}
+	}
+	return replicaResponse{tup: r, checksums: replicaChecksums(r.Res)}
+}
+
+// verifyChecksums compares checksums of successful responses with first
+// one, mismatches are logged to synclog. Returns true if all match.
+func (rd *responseMerger) verifyChecksums(succeeded []replicaResponse) bool {
+	if len(succeeded) < 2 || !rd.checksums.enabled(succeeded[0].tup.Req) {
+		return true
+	}
+	first := succeeded[0].tup
+	expected := succeeded[0].checksums
+	consistent := true
+	for _, replica := range succeeded[1:] {
+		r := replica.tup
+		diff := checksumsDiff(expected, replica.checksums)
+		if diff == "" {
+			continue
+		}
+		consistent = false
+		reqID, _ := r.Req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Checksum mismatch for request %s between %s and %s: %s", reqID, first.Req.Host, r.Req.Host, diff)
+		metrics.Mark(fmt.Sprintf("reqs.inconsistencies.%s.checksum", metrics.Clean(r.Req.Host)))
+		if rd.methodSetFilter == nil || !rd.methodSetFilter.Contains(r.Req.Method) {
+			continue
+		}
+		syncLogMsg := NewSyncLogMessageData(
+			r.Req.Method,
+			r.Req.Host,
+			first.Req.URL.Path,
+			first.Req.Host,
+			r.Req.Header.Get("User-Agent"),
+			reqID,
+			"Checksum mismatch: "+diff,
+			first.Res.ContentLength)
+		logMsg, err := json.Marshal(syncLogMsg)
+		if err != nil {
+			continue
+		}
+		rd.syncerrlog.Println(string(logMsg))
+	}
+	return consistent
+}
+
+// checksumMismatchTuple replaces successful response if checksums did not
+// match and verification is strict
+func checksumMismatchTuple(successfulTup transport.ReqResErrTuple) transport.ReqResErrTuple {
+	discardResponsesBodies([]transport.ReqResErrTuple{successfulTup})
+	return transport.ReqResErrTuple{
+		Req:    successfulTup.Req,
+		Err:    ErrReplicaChecksumMismatch,
+		Failed: true,
+	}
+}
@@ -0,0 +1,137 @@
+package httphandler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/signature"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ClientCredentials are access key of client, with secret key and tenant
+// owning it
+type ClientCredentials struct {
+	AccessKey string `yaml:"AccessKey"`
+	SecretKey string `yaml:"SecretKey"`
+	Tenant    string `yaml:"Tenant"`
+}
+
+type credentialsFile struct {
+	Credentials []ClientCredentials `yaml:"Credentials"`
+}
+
+// Client is authenticated client, it's stored in request context under
+// log.ContextClientKey
+type Client struct {
+	AccessKey string
+	Tenant    string
+}
+
+// ClientFromContext returns client which signed request
+func ClientFromContext(ctx context.Context) (Client, bool) {
+	client, ok := ctx.Value(log.ContextClientKey).(Client)
+	return client, ok
+}
+
+// CredentialStore keeps client credentials read from file, file is read
+// again when it's modified
+type CredentialStore struct {
+	file        *watchedFile
+	mx          sync.RWMutex
+	credentials map[string]ClientCredentials
+}
+
+// newCredentialStore reads credentials file, zero interval means default
+// interval of file changes checks
+func newCredentialStore(path string, interval time.Duration) (*CredentialStore, error) {
+	cs := &CredentialStore{file: newWatchedFile(path, interval)}
+	return cs, cs.Reload()
+}
+
+// Reload reads credentials file if its modification time or size changed
+// since last read, on error previous credentials are kept
+func (cs *CredentialStore) Reload() error {
+	return cs.file.reload(cs.parse)
+}
+
+func (cs *CredentialStore) parse(content []byte) error {
+	file := credentialsFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return err
+	}
+	credentials := make(map[string]ClientCredentials, len(file.Credentials))
+	for _, creds := range file.Credentials {
+		if creds.AccessKey == "" || creds.SecretKey == "" {
+			return fmt.Errorf("entry without AccessKey or SecretKey")
+		}
+		if _, duplicated := credentials[creds.AccessKey]; duplicated {
+			return fmt.Errorf("duplicated AccessKey %s", creds.AccessKey)
+		}
+		credentials[creds.AccessKey] = creds
+	}
+	cs.mx.Lock()
+	cs.credentials = credentials
+	cs.mx.Unlock()
+	metrics.UpdateGauge("clientauth.credentials", int64(len(credentials)))
+	return nil
+}
+
+// Lookup returns credentials of access key
+func (cs *CredentialStore) Lookup(accessKey string) (ClientCredentials, bool) {
+	cs.mx.RLock()
+	defer cs.mx.RUnlock()
+	creds, ok := cs.credentials[accessKey]
+	return creds, ok
+}
+
+func (cs *CredentialStore) secretKey(accessKey string) (string, bool) {
+	creds, ok := cs.Lookup(accessKey)
+	return creds.SecretKey, ok
+}
+
+// Start checks credentials file for changes in background
+func (cs *CredentialStore) Start() {
+	cs.file.start("clientauth", cs.Reload)
+}
+
+// Stop terminates credentials file checks
+func (cs *CredentialStore) Stop() {
+	cs.file.close()
+}
+
+type clientAuth struct {
+	store        *CredentialStore
+	verifier     *signature.Verifier
+	roundTripper http.RoundTripper
+}
+
+func (ca *clientAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	accessKey, err := ca.verifier.Verify(req)
+	if err != nil {
+		reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Rejected request %s from %s: %s", reqID, req.RemoteAddr, err)
+		metrics.Mark("clientauth.denied")
+		return S3ErrorResponse(req, S3AccessDenied.WithMessage(err.Error()+".")), nil
+	}
+	creds, _ := ca.store.Lookup(accessKey)
+	client := Client{AccessKey: accessKey, Tenant: creds.Tenant}
+	return ca.roundTripper.RoundTrip(req.WithContext(context.WithValue(req.Context(), log.ContextClientKey, client)))
+}
+
+// ClientAuth creates Decorator rejecting requests without valid signature
+// of client from store, domains are region domains. Client is passed in
+// request context.
+func ClientAuth(store *CredentialStore, domains []string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &clientAuth{
+			store:        store,
+			verifier:     signature.NewVerifier(store.secretKey, domains),
+			roundTripper: roundTripper,
+		}
+	}
+}
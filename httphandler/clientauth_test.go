@@ -0,0 +1,130 @@
+package httphandler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCredentials = `
+Credentials:
+  - AccessKey: client-key
+    SecretKey: client-secret
+    Tenant: team-a
+`
+
+func mkCredentialsFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "akubra-credentials-test")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "credentials.yaml")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// rewriteCredentialsFile changes file content and modification time
+func rewriteCredentialsFile(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestCredentialStoreReloadsChangedFile(t *testing.T) {
+	path := mkCredentialsFile(t, testCredentials)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	store, err := newCredentialStore(path, time.Hour)
+	require.NoError(t, err)
+
+	creds, ok := store.Lookup("client-key")
+	require.True(t, ok)
+	assert.Equal(t, "team-a", creds.Tenant)
+
+	rewriteCredentialsFile(t, path, strings.Replace(testCredentials, "client-key", "new-key", 1))
+	require.NoError(t, store.Reload())
+
+	_, ok = store.Lookup("client-key")
+	assert.False(t, ok)
+	_, ok = store.Lookup("new-key")
+	assert.True(t, ok)
+}
+
+func TestCredentialStoreKeepsCredentialsOnInvalidFile(t *testing.T) {
+	path := mkCredentialsFile(t, testCredentials)
+	defer func() { _ = os.RemoveAll(filepath.Dir(path)) }()
+	store, err := newCredentialStore(path, time.Hour)
+	require.NoError(t, err)
+
+	rewriteCredentialsFile(t, path, "Credentials:\n  - AccessKey: without-secret\n")
+
+	assert.Error(t, store.Reload())
+	_, ok := store.Lookup("client-key")
+	assert.True(t, ok)
+}
+
+func mkClientAuth(t *testing.T, inner http.RoundTripper) (http.RoundTripper, func()) {
+	path := mkCredentialsFile(t, testCredentials)
+	store, err := newCredentialStore(path, time.Hour)
+	require.NoError(t, err)
+	return ClientAuth(store, []string{"s3.local"})(inner), func() { _ = os.RemoveAll(filepath.Dir(path)) }
+}
+
+// signedRequest returns request signed with V4 by client
+func signedRequest(accessKey, secretKey string) *http.Request {
+	req := httptest.NewRequest("GET", "/bucket/key", nil)
+	req.Host = "s3.local"
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signer := signature.NewSigner(signature.Credentials{AccessKey: accessKey, SecretKey: secretKey})
+	// signer re-signs only signed requests
+	orig := httptest.NewRequest("GET", "/bucket/key", nil)
+	orig.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=client")
+	signer.Process(orig, []*http.Request{req})
+	return req.WithContext(context.WithValue(req.Context(), log.ContextreqIDKey, "reqid"))
+}
+
+func TestClientAuthPassesClientOfValidSignature(t *testing.T) {
+	var client Client
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		client, _ = ClientFromContext(req.Context())
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	auth, cleanup := mkClientAuth(t, inner)
+	defer cleanup()
+
+	resp, err := auth.RoundTrip(signedRequest("client-key", "client-secret"))
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, Client{AccessKey: "client-key", Tenant: "team-a"}, client)
+}
+
+func TestClientAuthRejectsInvalidRequests(t *testing.T) {
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Error("Rejected request shouldn't be sent")
+		return nil, nil
+	})
+	auth, cleanup := mkClientAuth(t, inner)
+	defer cleanup()
+
+	for name, req := range map[string]*http.Request{
+		"anonymous":      httptest.NewRequest("GET", "/bucket/key", nil),
+		"wrong secret":   signedRequest("client-key", "other-secret"),
+		"unknown client": signedRequest("other-key", "client-secret"),
+	} {
+		resp, err := auth.RoundTrip(req)
+
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, name)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "<Code>AccessDenied</Code>", name)
+	}
+}
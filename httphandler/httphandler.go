@@ -3,14 +3,21 @@ package httphandler
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"sync/atomic"
 	"time"
 
 	"github.com/allegro/akubra/config"
 	"github.com/allegro/akubra/log"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
 )
 
 const (
@@ -36,6 +43,7 @@ type Handler struct {
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	randomIDStr := randomStr(12)
 	canServe := true
 	if atomic.AddInt32(&h.runningRequestCount, 1) > h.maxConcurrentRequests {
 		canServe = false
@@ -43,25 +51,41 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	defer atomic.AddInt32(&h.runningRequestCount, -1)
 	if !canServe {
 		log.Printf("Rejected request from %s - too many other requests in progress.", req.Host)
-		http.Error(w, "Too many requests in progress.", http.StatusServiceUnavailable)
+		writeS3Error(w, req, randomIDStr, S3SlowDown.WithMessage("Too many requests in progress."))
 		return
 	}
 
-	randomIDStr := randomStr(12)
 	validationCode := h.validateIncomingRequest(req)
 	if validationCode > 0 {
 		log.Printf("Rejected invalid incoming request from %s, code %d", req.RemoteAddr, validationCode)
-		w.WriteHeader(validationCode)
+		writeS3Error(w, req, randomIDStr, s3ErrorForStatus(validationCode))
 		return
 	}
 
 	randomIDContext := context.WithValue(req.Context(), log.ContextreqIDKey, randomIDStr)
 	log.Debugf("Request id %s", randomIDStr)
 
+	// Size of body without Content-Length is checked while it's read
+	var limitedBody *maxSizeBody
+	if req.ContentLength < 0 && req.Body != nil {
+		limitedBody = &maxSizeBody{ReadCloser: req.Body, remaining: h.bodyMaxSize}
+		req.Body = limitedBody
+	}
+
 	resp, err := h.roundTripper.RoundTrip(req.WithContext(randomIDContext))
 
+	if limitedBody != nil && limitedBody.exceeded() {
+		log.Printf("Rejected request %s from %s, body exceeds %d bytes", randomIDStr, req.RemoteAddr, h.bodyMaxSize)
+		if err == nil {
+			discardBody(resp)
+		}
+		writeS3Error(w, req, randomIDStr, S3EntityTooLarge)
+		return
+	}
+
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Debugf("Request %s failed: %s", randomIDStr, err)
+		writeS3Error(w, req, randomIDStr, s3ErrorFor(err))
 		return
 	}
 	defer func() {
@@ -84,6 +108,49 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// ErrBodyTooLarge is returned by request body reader if body of unknown
+// length exceeds body max size
+var ErrBodyTooLarge = errors.New("Request body too large")
+
+// maxSizeBody fails reads once more than remaining bytes are read
+type maxSizeBody struct {
+	io.ReadCloser
+	remaining    int64
+	tooLargeFlag int32
+}
+
+func (msb *maxSizeBody) Read(p []byte) (int, error) {
+	if msb.exceeded() {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte more than allowed to find out if body is too large
+	if int64(len(p)) > msb.remaining+1 {
+		p = p[:msb.remaining+1]
+	}
+	n, err := msb.ReadCloser.Read(p)
+	if int64(n) <= msb.remaining {
+		msb.remaining -= int64(n)
+		return n, err
+	}
+	n = int(msb.remaining)
+	msb.remaining = 0
+	atomic.StoreInt32(&msb.tooLargeFlag, 1)
+	return n, ErrBodyTooLarge
+}
+
+func (msb *maxSizeBody) exceeded() bool {
+	return atomic.LoadInt32(&msb.tooLargeFlag) == 1
+}
+
+func discardBody(resp *http.Response) {
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		log.Debugf("Cannot discard response body: %s", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Debugf("Cannot close response body: %s", err)
+	}
+}
+
 func (h *Handler) validateIncomingRequest(req *http.Request) int {
 	return config.RequestHeaderContentLengthValidator(*req, h.bodyMaxSize)
 }
@@ -110,18 +177,138 @@ func ConfigureHTTPTransport(conf config.Config) (*http.Transport, error) {
 		DisableKeepAlives:     conf.DisableKeepAlives,
 	}
 
+	tlsConfig, err := NewTLSConfig(conf.BackendTLS)
+	if err != nil {
+		return nil, err
+	}
+	httpTransport.TLSClientConfig = tlsConfig
+
+	return httpTransport, nil
+}
+
+// ConfigureClusterHTTPTransport returns http.Transport configured like
+// ConfigureHTTPTransport, with overrides applied in order
+func ConfigureClusterHTTPTransport(conf config.Config, overrides ...shardingconfig.TransportConfig) (*http.Transport, error) {
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, override := range overrides {
+		if override.DialTimeout.Duration != 0 {
+			dialer := &net.Dialer{
+				Timeout:   override.DialTimeout.Duration,
+				KeepAlive: 30 * time.Second,
+			}
+			httpTransport.DialContext = dialer.DialContext
+		}
+		if override.ResponseHeaderTimeout.Duration != 0 {
+			httpTransport.ResponseHeaderTimeout = override.ResponseHeaderTimeout.Duration
+		}
+		if override.MaxIdleConns != 0 {
+			httpTransport.MaxIdleConns = override.MaxIdleConns
+		}
+		if override.MaxIdleConnsPerHost != 0 {
+			httpTransport.MaxIdleConnsPerHost = override.MaxIdleConnsPerHost
+		}
+		if override.IdleConnTimeout.Duration != 0 {
+			httpTransport.IdleConnTimeout = override.IdleConnTimeout.Duration
+		}
+		if override.MaxConnsPerHost != 0 {
+			httpTransport.MaxConnsPerHost = override.MaxConnsPerHost
+		}
+		if override.DisableKeepAlives != nil {
+			httpTransport.DisableKeepAlives = *override.DisableKeepAlives
+		}
+		if override.TLS != nil {
+			tlsConfig, err := NewTLSConfig(*override.TLS)
+			if err != nil {
+				return nil, err
+			}
+			httpTransport.TLSClientConfig = tlsConfig
+		}
+	}
 	return httpTransport, nil
 }
 
-// DecorateRoundTripper applies common http.RoundTripper decorators
-func DecorateRoundTripper(conf config.Config, rt http.RoundTripper) http.RoundTripper {
-	return Decorate(
-		rt,
-		HeadersSuplier(conf.AdditionalRequestHeaders, conf.AdditionalResponseHeaders),
+// NewTLSConfig creates tls.Config for backend connections, reads CA bundle
+// and client certificate from files
+func NewTLSConfig(conf shardingconfig.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if conf.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %q", conf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		if conf.CertFile == "" || conf.KeyFile == "" {
+			return nil, errors.New("client certificate requires both CertFile and KeyFile")
+		}
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// DecorateRoundTripper applies common http.RoundTripper decorators,
+// requests are authenticated with credentials unless it's nil,
+// statusCheckers are consulted on health check endpoint
+func DecorateRoundTripper(conf config.Config, rt http.RoundTripper, credentials *CredentialStore, policies *PolicyStore, statusCheckers ...StatusChecker) http.RoundTripper {
+	decorators := []Decorator{HeadersSuplier(conf.AdditionalRequestHeaders, conf.AdditionalResponseHeaders)}
+	if policies != nil {
+		decorators = append(decorators, Policies(policies, regionDomains(conf)))
+	}
+	if credentials != nil {
+		decorators = append(decorators, ClientAuth(credentials, regionDomains(conf)))
+	}
+	decorators = append(decorators,
 		AccessLogging(conf.Accesslog),
 		OptionsHandler,
-		HealthCheckHandler(conf.HealthCheckEndpoint),
+		HealthCheckHandler(conf.HealthCheckEndpoint, statusCheckers...),
 	)
+	return Decorate(rt, decorators...)
+}
+
+func regionDomains(conf config.Config) []string {
+	domains := []string{}
+	for _, regionConfig := range conf.Regions {
+		domains = append(domains, regionConfig.Domains...)
+	}
+	return domains
+}
+
+// NewCredentialStore creates client credentials store from configuration,
+// returns nil if client authentication is disabled
+func NewCredentialStore(conf config.Config) (*CredentialStore, error) {
+	authConf := conf.ClientAuth
+	if !authConf.Enabled {
+		return nil, nil
+	}
+	return newCredentialStore(authConf.CredentialsFile, authConf.ReloadInterval.Duration)
+}
+
+// NewPolicyStore creates access policies store from configuration, returns
+// nil if policies are disabled
+func NewPolicyStore(conf config.Config) (*PolicyStore, error) {
+	policiesConf := conf.AccessPolicies
+	if !policiesConf.Enabled {
+		return nil, nil
+	}
+	if !conf.ClientAuth.Enabled {
+		return nil, errors.New("AccessPolicies require ClientAuth enabled")
+	}
+	return newPolicyStore(policiesConf.PolicyFile, policiesConf.ReloadInterval.Duration)
 }
 
 // NewHandlerWithRoundTripper returns Handler, but will not construct transport.MultiTransport by itself
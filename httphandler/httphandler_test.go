@@ -1,11 +1,25 @@
 package httphandler
 
 import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestShouldReturnEntityTooLargeCode(t *testing.T) {
@@ -17,6 +31,28 @@ func TestShouldReturnEntityTooLargeCode(t *testing.T) {
 	assert.Equal(t, http.StatusRequestEntityTooLarge, writer.Code)
 }
 
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (rtf roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rtf(req)
+}
+
+func TestShouldReturnEntityTooLargeCodeForChunkedBody(t *testing.T) {
+	request := httptest.NewRequest("PUT", "http://somepath", bytes.NewBufferString("too large body"))
+	request.ContentLength = -1
+	request.TransferEncoding = []string{"chunked"}
+	var readErr error
+	roundTripper := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		_, readErr = ioutil.ReadAll(req.Body)
+		return nil, readErr
+	})
+	handler := &Handler{roundTripper: roundTripper, bodyMaxSize: 4, maxConcurrentRequests: 10}
+	writer := httptest.NewRecorder()
+	handler.ServeHTTP(writer, request)
+	assert.Equal(t, ErrBodyTooLarge, readErr)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, writer.Code)
+}
+
 func TestShouldReturnBadRequestOnUnparsableContentLengthHeader(t *testing.T) {
 	request := httptest.NewRequest("POST", "http://somepath", nil)
 	request.Header.Set("Content-Length", "strange-content-header")
@@ -34,6 +70,46 @@ func TestShouldReturnServiceNotAvailableOnTooManyRequests(t *testing.T) {
 	assert.Equal(t, http.StatusServiceUnavailable, writer.Code)
 }
 
+func TestShouldReturnS3SlowDownErrorOnTooManyRequests(t *testing.T) {
+	request := httptest.NewRequest("GET", "http://somepath/bucket/object", nil)
+	handler := &Handler{bodyMaxSize: 1024, maxConcurrentRequests: 0}
+	writer := httptest.NewRecorder()
+
+	handler.ServeHTTP(writer, request)
+
+	reqID := writer.Header().Get("x-amz-request-id")
+	assert.NotEmpty(t, reqID)
+	assert.Equal(t, "application/xml", writer.Header().Get("Content-Type"))
+	assert.Contains(t, writer.Body.String(), "<Code>SlowDown</Code>")
+	assert.Contains(t, writer.Body.String(), "<Resource>/bucket/object</Resource>")
+	assert.Contains(t, writer.Body.String(), "<RequestId>"+reqID+"</RequestId>")
+}
+
+func TestShouldMapRoundTripErrorsToS3Errors(t *testing.T) {
+	for err, expected := range map[error]S3Error{
+		errors.New("unexpected"):         S3InternalError,
+		ErrQuorumNotReached:              S3InternalError,
+		transport.ErrBulkheadFull:        S3SlowDown,
+		transport.ErrCircuitOpen:         S3SlowDown,
+		transport.ErrSpillSpaceExhausted: S3SlowDown,
+	} {
+		roundTripErr := err
+		var reqID interface{}
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			reqID = req.Context().Value(log.ContextreqIDKey)
+			return nil, roundTripErr
+		})
+		handler := &Handler{bodyMaxSize: 1024, maxConcurrentRequests: 1, roundTripper: rt}
+		writer := httptest.NewRecorder()
+
+		handler.ServeHTTP(writer, httptest.NewRequest("GET", "http://somepath/bucket/object", nil))
+
+		assert.Equal(t, expected.StatusCode, writer.Code, err.Error())
+		assert.Contains(t, writer.Body.String(), "<Code>"+expected.Code+"</Code>", err.Error())
+		assert.Contains(t, writer.Body.String(), fmt.Sprintf("<RequestId>%s</RequestId>", reqID), err.Error())
+	}
+}
+
 func TestShouldReturnStatusOKOnHealthCheckEndpoint(t *testing.T) {
 	expectedBody := `OK`
 	expectedStatusCode := http.StatusOK
@@ -57,3 +133,77 @@ func TestShouldReturnStatusOKOnHealthCheckEndpoint(t *testing.T) {
 	assert.Equal(t, expectedStatusCode, writer.Code)
 	assert.Equal(t, expectedBody, bodyStr)
 }
+
+func TestShouldReturnServiceUnavailableOnHealthCheckEndpointWhenCheckerFails(t *testing.T) {
+	healthCheckPath := "/status/ping"
+	request := httptest.NewRequest("GET", "http://localhost"+healthCheckPath, nil)
+	failing := func() error { return errors.New("region down") }
+	rt := Decorate(http.DefaultTransport, HealthCheckHandler(healthCheckPath, failing))
+	handler := &Handler{bodyMaxSize: 1024, maxConcurrentRequests: 1, roundTripper: rt}
+	writer := httptest.NewRecorder()
+
+	handler.ServeHTTP(writer, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, writer.Code)
+	assert.Equal(t, "region down", writer.Body.String())
+}
+
+func TestClusterHTTPTransportOverridesGlobalSettings(t *testing.T) {
+	conf := config.Config{}
+	conf.MaxIdleConns = 10
+	conf.ResponseHeaderTimeout = metrics.Interval{Duration: time.Second}
+	disableKeepAlives := true
+	clusterConf := shardingconfig.TransportConfig{
+		ResponseHeaderTimeout: metrics.Interval{Duration: 3 * time.Second},
+		MaxConnsPerHost:       5,
+	}
+	backendConf := shardingconfig.TransportConfig{
+		MaxConnsPerHost:   7,
+		DisableKeepAlives: &disableKeepAlives,
+	}
+
+	transp, err := ConfigureClusterHTTPTransport(conf, clusterConf, backendConf)
+	require.NoError(t, err)
+	assert.Equal(t, 10, transp.MaxIdleConns)
+	assert.Equal(t, defaultMaxIdleConnsPerHost, transp.MaxIdleConnsPerHost)
+	assert.Equal(t, 3*time.Second, transp.ResponseHeaderTimeout)
+	assert.Equal(t, 7, transp.MaxConnsPerHost)
+	assert.True(t, transp.DisableKeepAlives)
+}
+
+func TestHTTPTransportTrustsConfiguredCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	caFile, err := ioutil.TempFile("", "akubra-ca")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(caFile.Name()) }()
+	require.NoError(t, pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	require.NoError(t, caFile.Close())
+
+	conf := config.Config{}
+	conf.BackendTLS = shardingconfig.TLSConfig{CAFile: caFile.Name()}
+	httpTransport, err := ConfigureHTTPTransport(conf)
+	require.NoError(t, err)
+	backend, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	multiTransport := transport.NewMultiTransport(httpTransport, []url.URL{*backend}, nil, nil)
+
+	req := httptest.NewRequest("GET", "/bucket/key", nil)
+	req.RequestURI = ""
+	resp, err := multiTransport.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestTLSConfigRequiresCertificateAndKey(t *testing.T) {
+	_, err := NewTLSConfig(shardingconfig.TLSConfig{CertFile: "client.pem"})
+	assert.Error(t, err)
+	_, err = NewTLSConfig(shardingconfig.TLSConfig{CAFile: "/nonexistent/ca.pem"})
+	assert.Error(t, err)
+	tlsConfig, err := NewTLSConfig(shardingconfig.TLSConfig{ServerName: "s3.internal", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	assert.Equal(t, "s3.internal", tlsConfig.ServerName)
+	assert.True(t, tlsConfig.InsecureSkipVerify)
+}
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
 )
 
 // AccessMessageData holds all important informations
@@ -20,6 +21,7 @@ type AccessMessageData struct {
 	RespErr    string  `json:"error"`
 	ReqID      string  `json:"reqID"`
 	Time       string  `json:"ts"`
+	Retries    int32   `json:"retries"`
 }
 
 // String produces data in csv format with fields in following order:
@@ -41,7 +43,7 @@ func NewAccessLogMessage(req http.Request,
 		req.URL.Path,
 		req.Header.Get("User-Agent"),
 		statusCode, duration * 1000, respErr,
-		reqID, ts}
+		reqID, ts, transport.Retries(req.Context())}
 }
 
 // ScanCSVAccessLogMessage will scan csv string and return AccessMessageData.
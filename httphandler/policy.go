@@ -0,0 +1,226 @@
+package httphandler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+	"github.com/allegro/akubra/transport"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Operations allowed by policy rules
+const (
+	OperationRead   = "read"
+	OperationWrite  = "write"
+	OperationDelete = "delete"
+	OperationList   = "list"
+)
+
+// anyBucket matches all buckets in policy rule
+const anyBucket = "*"
+
+// PolicyRule allows operations on keys with Prefix in Bucket
+type PolicyRule struct {
+	// Bucket name or * for all buckets
+	Bucket string `yaml:"Bucket"`
+	// Key prefix, empty prefix allows whole bucket
+	Prefix     string   `yaml:"Prefix"`
+	Operations []string `yaml:"Operations"`
+}
+
+// Policy lists rules of access key
+type Policy struct {
+	AccessKey string       `yaml:"AccessKey"`
+	Rules     []PolicyRule `yaml:"Rules"`
+}
+
+type policyFile struct {
+	Policies []Policy `yaml:"Policies"`
+}
+
+// PolicyStore keeps access policies read from file, file is read again
+// when it's modified. Access keys without policy are denied all operations.
+type PolicyStore struct {
+	file     *watchedFile
+	mx       sync.RWMutex
+	policies map[string][]PolicyRule
+}
+
+// newPolicyStore reads policy file, zero interval means default interval
+// of file changes checks
+func newPolicyStore(path string, interval time.Duration) (*PolicyStore, error) {
+	ps := &PolicyStore{file: newWatchedFile(path, interval)}
+	return ps, ps.Reload()
+}
+
+// Reload reads policy file if its modification time or size changed since
+// last read, on error previous policies are kept
+func (ps *PolicyStore) Reload() error {
+	return ps.file.reload(ps.parse)
+}
+
+func (ps *PolicyStore) parse(content []byte) error {
+	file := policyFile{}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return err
+	}
+	policies := make(map[string][]PolicyRule, len(file.Policies))
+	for _, policy := range file.Policies {
+		if policy.AccessKey == "" {
+			return fmt.Errorf("policy without AccessKey")
+		}
+		if _, duplicated := policies[policy.AccessKey]; duplicated {
+			return fmt.Errorf("duplicated policy of AccessKey %s", policy.AccessKey)
+		}
+		for _, rule := range policy.Rules {
+			if err := validateRule(rule); err != nil {
+				return fmt.Errorf("policy of AccessKey %s: %s", policy.AccessKey, err)
+			}
+		}
+		policies[policy.AccessKey] = policy.Rules
+	}
+	ps.mx.Lock()
+	ps.policies = policies
+	ps.mx.Unlock()
+	return nil
+}
+
+func validateRule(rule PolicyRule) error {
+	if rule.Bucket == "" {
+		return fmt.Errorf("rule without Bucket")
+	}
+	if len(rule.Operations) == 0 {
+		return fmt.Errorf("rule of bucket %s without Operations", rule.Bucket)
+	}
+	for _, operation := range rule.Operations {
+		switch operation {
+		case OperationRead, OperationWrite, OperationDelete, OperationList:
+		default:
+			return fmt.Errorf("unknown operation %q", operation)
+		}
+	}
+	return nil
+}
+
+// Allowed checks if access key may perform operation on key in bucket,
+// empty bucket is allowed only by rules of all buckets
+func (ps *PolicyStore) Allowed(accessKey, operation, bucket, key string) bool {
+	ps.mx.RLock()
+	defer ps.mx.RUnlock()
+	for _, rule := range ps.policies[accessKey] {
+		if rule.Bucket != anyBucket && rule.Bucket != bucket {
+			continue
+		}
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		for _, allowed := range rule.Operations {
+			if allowed == operation {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Start checks policy file for changes in background
+func (ps *PolicyStore) Start() {
+	ps.file.start("policy", ps.Reload)
+}
+
+// Stop terminates policy file checks
+func (ps *PolicyStore) Stop() {
+	ps.file.close()
+}
+
+// accessCheck is operation on key in bucket needed by request
+type accessCheck struct {
+	operation string
+	bucket    string
+	key       string
+}
+
+// requestAccessChecks returns operations performed by request. Listings are
+// checked against prefix query parameter, bucket level requests and
+// multi-object deletes are allowed only by rules without prefix.
+func requestAccessChecks(req *http.Request, domains []string) []accessCheck {
+	address := transport.ParseS3Address(req.Host, req.URL.Path, domains)
+	query := req.URL.Query()
+	check := accessCheck{operation: OperationWrite, bucket: address.Bucket, key: address.Key}
+	switch {
+	case req.Method == http.MethodDelete && query.Get("uploadId") == "":
+		check.operation = OperationDelete
+	case req.Method == http.MethodDelete:
+		// aborting multipart upload discards only uploaded parts
+		check.operation = OperationWrite
+	case req.Method == http.MethodPost && address.Key == "" && hasQueryParam(query, "delete"):
+		check.operation = OperationDelete
+	case (req.Method == http.MethodGet || req.Method == http.MethodHead) && address.Key == "":
+		check.operation = OperationList
+		check.key = query.Get("prefix")
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		check.operation = OperationRead
+	}
+	checks := []accessCheck{check}
+	if source, ok := copySource(req); ok {
+		checks = append(checks, source)
+	}
+	return checks
+}
+
+func hasQueryParam(query url.Values, name string) bool {
+	_, ok := query[name]
+	return ok
+}
+
+// copySource returns read of object copied by request
+func copySource(req *http.Request) (accessCheck, bool) {
+	header := req.Header.Get("x-amz-copy-source")
+	if header == "" {
+		return accessCheck{}, false
+	}
+	if i := strings.Index(header, "?versionId="); i >= 0 {
+		header = header[:i]
+	}
+	source, err := url.PathUnescape(header)
+	if err != nil {
+		source = header
+	}
+	address := transport.ParseS3Address("", source, nil)
+	return accessCheck{operation: OperationRead, bucket: address.Bucket, key: address.Key}, true
+}
+
+type policyEnforcer struct {
+	store        *PolicyStore
+	domains      []string
+	roundTripper http.RoundTripper
+}
+
+func (pe *policyEnforcer) RoundTrip(req *http.Request) (*http.Response, error) {
+	client, ok := ClientFromContext(req.Context())
+	for _, check := range requestAccessChecks(req, pe.domains) {
+		if ok && pe.store.Allowed(client.AccessKey, check.operation, check.bucket, check.key) {
+			continue
+		}
+		reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Denied %s of %s/%s to %q in request %s", check.operation, check.bucket, check.key, client.AccessKey, reqID)
+		metrics.Mark("policy.denied." + metrics.Clean(client.AccessKey))
+		return S3ErrorResponse(req, S3AccessDenied), nil
+	}
+	return pe.roundTripper.RoundTrip(req)
+}
+
+// Policies creates Decorator rejecting requests not allowed by policies of
+// client access key, domains are region domains. It requires client in
+// request context, so it has to be wrapped by ClientAuth.
+func Policies(store *PolicyStore, domains []string) Decorator {
+	return func(roundTripper http.RoundTripper) http.RoundTripper {
+		return &policyEnforcer{store: store, domains: domains, roundTripper: roundTripper}
+	}
+}
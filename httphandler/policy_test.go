@@ -0,0 +1,168 @@
+package httphandler
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicies = `
+Policies:
+  - AccessKey: client-key
+    Rules:
+      - Bucket: photos
+        Prefix: public/
+        Operations: [read, list]
+      - Bucket: uploads
+        Operations: [read, write, delete, list]
+  - AccessKey: admin-key
+    Rules:
+      - Bucket: "*"
+        Operations: [read, write, delete, list]
+`
+
+func mkPolicyStore(t *testing.T, content string) (*PolicyStore, func()) {
+	path := mkCredentialsFile(t, content)
+	store, err := newPolicyStore(path, time.Hour)
+	require.NoError(t, err)
+	return store, func() { _ = os.RemoveAll(filepath.Dir(path)) }
+}
+
+func TestPolicyStoreAllowed(t *testing.T) {
+	store, cleanup := mkPolicyStore(t, testPolicies)
+	defer cleanup()
+
+	testCases := []struct {
+		accessKey, operation, bucket, key string
+		allowed                           bool
+	}{
+		{"client-key", OperationRead, "photos", "public/cat.jpg", true},
+		{"client-key", OperationRead, "photos", "private/cat.jpg", false},
+		{"client-key", OperationWrite, "photos", "public/cat.jpg", false},
+		{"client-key", OperationList, "photos", "", false},
+		{"client-key", OperationDelete, "uploads", "file", true},
+		{"client-key", OperationList, "", "", false},
+		{"admin-key", OperationDelete, "photos", "private/cat.jpg", true},
+		{"admin-key", OperationList, "", "", true},
+		{"unknown-key", OperationRead, "uploads", "file", false},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.allowed, store.Allowed(tc.accessKey, tc.operation, tc.bucket, tc.key), "%v", tc)
+	}
+}
+
+func TestPolicyStoreRejectsInvalidPolicies(t *testing.T) {
+	for _, content := range []string{
+		"Policies:\n  - Rules:\n      - Bucket: photos\n        Operations: [read]\n",
+		"Policies:\n  - AccessKey: key\n    Rules:\n      - Bucket: photos\n        Operations: [execute]\n",
+		"Policies:\n  - AccessKey: key\n    Rules:\n      - Bucket: photos\n",
+	} {
+		path := mkCredentialsFile(t, content)
+		_, err := newPolicyStore(path, time.Hour)
+		assert.Error(t, err, content)
+		_ = os.RemoveAll(filepath.Dir(path))
+	}
+}
+
+func TestRequestAccessChecks(t *testing.T) {
+	testCases := []struct {
+		method, host, url string
+		copySource        string
+		expected          []accessCheck
+	}{
+		{"GET", "s3.local", "/photos/a/b.jpg", "", []accessCheck{{OperationRead, "photos", "a/b.jpg"}}},
+		{"HEAD", "photos.s3.local", "/a/b.jpg", "", []accessCheck{{OperationRead, "photos", "a/b.jpg"}}},
+		{"GET", "s3.local", "/photos?prefix=public/", "", []accessCheck{{OperationList, "photos", "public/"}}},
+		{"GET", "s3.local", "/", "", []accessCheck{{OperationList, "", ""}}},
+		{"PUT", "s3.local", "/photos/a", "", []accessCheck{{OperationWrite, "photos", "a"}}},
+		{"POST", "s3.local", "/photos/a?uploads", "", []accessCheck{{OperationWrite, "photos", "a"}}},
+		{"DELETE", "s3.local", "/photos/a", "", []accessCheck{{OperationDelete, "photos", "a"}}},
+		{"DELETE", "s3.local", "/photos/a?uploadId=1", "", []accessCheck{{OperationWrite, "photos", "a"}}},
+		{"POST", "s3.local", "/photos?delete", "", []accessCheck{{OperationDelete, "photos", ""}}},
+		{"PUT", "s3.local", "/photos/a", "/uploads/b%20c?versionId=1", []accessCheck{
+			{OperationWrite, "photos", "a"},
+			{OperationRead, "uploads", "b c"},
+		}},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		req.Host = tc.host
+		if tc.copySource != "" {
+			req.Header.Set("x-amz-copy-source", tc.copySource)
+		}
+
+		assert.Equal(t, tc.expected, requestAccessChecks(req, []string{"s3.local"}), "%s %s", tc.method, tc.url)
+	}
+}
+
+func clientRequest(method, url, accessKey string) *http.Request {
+	req := httptest.NewRequest(method, url, nil)
+	req.Host = "s3.local"
+	ctx := context.WithValue(req.Context(), log.ContextreqIDKey, "reqid")
+	ctx = context.WithValue(ctx, log.ContextClientKey, Client{AccessKey: accessKey})
+	return req.WithContext(ctx)
+}
+
+func TestPoliciesPassesAllowedRequest(t *testing.T) {
+	store, cleanup := mkPolicyStore(t, testPolicies)
+	defer cleanup()
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+
+	resp, err := Policies(store, []string{"s3.local"})(inner).RoundTrip(clientRequest("GET", "/photos/public/cat.jpg", "client-key"))
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestPoliciesDeniesRequestAndCountsDenials(t *testing.T) {
+	store, cleanup := mkPolicyStore(t, testPolicies)
+	defer cleanup()
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Error("Denied request shouldn't be sent")
+		return nil, nil
+	})
+	policies := Policies(store, []string{"s3.local"})(inner)
+	meter := gometrics.GetOrRegisterMeter("policy.denied.denied-client", gometrics.DefaultRegistry)
+	denied := meter.Count()
+
+	for _, req := range []*http.Request{
+		clientRequest("PUT", "/photos/public/cat.jpg", "denied-client"),
+		clientRequest("PUT", "/uploads/cat.jpg", "denied-client"),
+	} {
+		resp, err := policies.RoundTrip(req)
+
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Contains(t, string(body), "<Code>AccessDenied</Code>")
+	}
+	assert.Equal(t, denied+2, meter.Count())
+}
+
+func TestPoliciesDeniesCopyOfForbiddenSource(t *testing.T) {
+	store, cleanup := mkPolicyStore(t, testPolicies)
+	defer cleanup()
+	inner := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		t.Error("Denied request shouldn't be sent")
+		return nil, nil
+	})
+	req := clientRequest("PUT", "/uploads/cat.jpg", "client-key")
+	req.Header.Set("x-amz-copy-source", "/photos/private/cat.jpg")
+
+	resp, err := Policies(store, []string{"s3.local"})(inner).RoundTrip(req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
@@ -2,9 +2,11 @@ package httphandler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 
 	"github.com/allegro/akubra/config"
 	"github.com/allegro/akubra/log"
@@ -13,10 +15,19 @@ import (
 	set "github.com/deckarep/golang-set"
 )
 
+// ErrQuorumNotReached is returned to client if less than quorum backends
+// succeeded on write request
+var ErrQuorumNotReached = errors.New("Write quorum not reached")
+
 type responseMerger struct {
 	syncerrlog      log.Logger
 	methodSetFilter set.Set
 	fifo            bool
+	// quorum is number of successful responses required for write
+	// requests, zero means first success is enough
+	quorum int
+	// checksums compares PUT responses checksums, disabled if nil
+	checksums *checksumVerifier
 }
 
 func (rd *responseMerger) synclog(r, successfulTup transport.ReqResErrTuple) {
@@ -93,7 +104,9 @@ func (rd *responseMerger) _handle(in <-chan transport.ReqResErrTuple, out chan<-
 	var successfulTup transport.ReqResErrTuple
 	errs := []transport.ReqResErrTuple{}
 	nonErrs := []transport.ReqResErrTuple{}
+	succeeded := []replicaResponse{}
 	firstPassed := false
+	sentEarly := false
 
 	for {
 		r, hasMore := <-in
@@ -115,10 +128,14 @@ func (rd *responseMerger) _handle(in <-chan transport.ReqResErrTuple, out chan<-
 			r.Req.URL.Path,
 			r.Err)
 
+		if !r.Failed {
+			succeeded = append(succeeded, rd.checksums.collect(r))
+		}
 		if !r.Failed && !firstPassed {
 			successfulTup = r
-			if rd.fifo {
+			if rd.fifo && !rd.checksums.strict(r.Req) {
 				out <- r
+				sentEarly = true
 			}
 			firstPassed = true
 			continue
@@ -130,18 +147,119 @@ func (rd *responseMerger) _handle(in <-chan transport.ReqResErrTuple, out chan<-
 		}
 	}
 
-	if !rd.fifo && firstPassed {
-		out <- successfulTup
+	consistent := rd.verifyChecksums(succeeded)
+	if !sentEarly && firstPassed {
+		if !consistent && rd.checksums.strict(successfulTup.Req) {
+			out <- checksumMismatchTuple(successfulTup)
+		} else {
+			out <- successfulTup
+		}
 	}
 
 	firstPassed = rd.handleFailedResponces(nonErrs, out, firstPassed, successfulTup, rd.methodSetFilter)
 	rd.handleFailedResponces(errs, out, firstPassed, successfulTup, rd.methodSetFilter)
 }
 
+func isWriteMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+func discardResponsesBodies(tups []transport.ReqResErrTuple) {
+	for _, r := range tups {
+		if r.Res == nil || r.Res.Body == nil {
+			continue
+		}
+		_, err := io.Copy(ioutil.Discard, r.Res.Body)
+		if err != nil {
+			log.Printf("Could not discard body %s", err)
+		}
+		err = r.Res.Body.Close()
+		if err != nil {
+			log.Printf("Could not close body %s", err)
+		}
+	}
+}
+
+// quorumFor returns number of successes required for request
+func (rd *responseMerger) quorumFor(req *http.Request) int {
+	if !isWriteMethod(req.Method) {
+		return 1
+	}
+	return rd.quorum
+}
+
+// _handleQuorum passes first successful response as soon as quorum of
+// backends succeeded. If some, but not enough, backends succeeded
+// ErrQuorumNotReached is passed. Without any success first failure is passed.
+// Read requests need single success.
+func (rd *responseMerger) _handleQuorum(in <-chan transport.ReqResErrTuple, out chan<- transport.ReqResErrTuple) {
+	var successfulTup transport.ReqResErrTuple
+	successes := 0
+	succeeded := []replicaResponse{}
+	passed := false
+	failed := []transport.ReqResErrTuple{}
+	discard := []transport.ReqResErrTuple{}
+
+	for r := range in {
+		reqID, _ := r.Req.Context().Value(log.ContextreqIDKey).(string)
+		quorum := rd.quorumFor(r.Req)
+		if r.Failed {
+			log.Debugf("Quorum request %s failed on backend %s, error: %q", reqID, r.Req.Host, r.Err)
+			failed = append(failed, r)
+			continue
+		}
+		successes++
+		succeeded = append(succeeded, rd.checksums.collect(r))
+		if successes == 1 {
+			successfulTup = r
+		} else {
+			discard = append(discard, r)
+		}
+		if successes == quorum && !rd.checksums.strict(r.Req) {
+			out <- successfulTup
+			passed = true
+		}
+	}
+
+	consistent := rd.verifyChecksums(succeeded)
+	if !passed && successes > 0 && successes >= rd.quorumFor(successfulTup.Req) {
+		if !consistent {
+			out <- checksumMismatchTuple(successfulTup)
+		} else {
+			out <- successfulTup
+		}
+		passed = true
+	}
+
+	if !passed && successes > 0 {
+		reqID, _ := successfulTup.Req.Context().Value(log.ContextreqIDKey).(string)
+		log.Printf("Write quorum not reached for request %s, %d of %d required backends succeeded",
+			reqID, successes, rd.quorum)
+		metrics.Mark(fmt.Sprintf("reqs.quorum.failed.method-%s", successfulTup.Req.Method))
+		out <- transport.ReqResErrTuple{
+			Req:    successfulTup.Req,
+			Err:    ErrQuorumNotReached,
+			Failed: true,
+		}
+		passed = true
+		discard = append(discard, successfulTup)
+	}
+	rd.handleFailedResponces(failed, out, passed, successfulTup, rd.methodSetFilter)
+	discardResponsesBodies(discard)
+}
+
 func (rd *responseMerger) handleResponses(in <-chan transport.ReqResErrTuple) transport.ReqResErrTuple {
 	out := make(chan transport.ReqResErrTuple, 1)
 	go func() {
-		rd._handle(in, out)
+		if rd.quorum > 0 {
+			rd._handleQuorum(in, out)
+		} else {
+			rd._handle(in, out)
+		}
 		close(out)
 	}()
 	return <-out
@@ -151,9 +269,10 @@ func (rd *responseMerger) handleResponses(in <-chan transport.ReqResErrTuple) tr
 // responses, returns first successful response to caller
 func EarliestResponseHandler(conf config.Config) transport.MultipleResponsesHandler {
 	rh := responseMerger{
-		conf.Synclog,
-		conf.SyncLogMethodsSet,
-		true,
+		syncerrlog:      conf.Synclog,
+		methodSetFilter: conf.SyncLogMethodsSet,
+		checksums:       newChecksumVerifier(conf),
+		fifo:            true,
 	}
 	return rh.handleResponses
 }
@@ -163,9 +282,24 @@ func EarliestResponseHandler(conf config.Config) transport.MultipleResponsesHand
 // all other responces received
 func LateResponseHandler(conf config.Config) transport.MultipleResponsesHandler {
 	rh := responseMerger{
-		conf.Synclog,
-		conf.SyncLogMethodsSet,
-		false,
+		syncerrlog:      conf.Synclog,
+		methodSetFilter: conf.SyncLogMethodsSet,
+		checksums:       newChecksumVerifier(conf),
+		fifo:            false,
+	}
+	return rh.handleResponses
+}
+
+// QuorumResponseHandler returns a function which handles multiple
+// responses. Write requests are successful only if at least quorum
+// backends succeeded, for read requests first success is enough
+func QuorumResponseHandler(conf config.Config, quorum int) transport.MultipleResponsesHandler {
+	rh := responseMerger{
+		syncerrlog:      conf.Synclog,
+		methodSetFilter: conf.SyncLogMethodsSet,
+		checksums:       newChecksumVerifier(conf),
+		fifo:            true,
+		quorum:          quorum,
 	}
 	return rh.handleResponses
 }
@@ -0,0 +1,166 @@
+package httphandler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
+	set "github.com/deckarep/golang-set"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// syncBuffer is bytes.Buffer safe for concurrent logging and reading
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) Contains(sub string) bool {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+	return bytes.Contains(sb.buf.Bytes(), []byte(sub))
+}
+
+func mkSyncLogConfig(buf *syncBuffer) config.Config {
+	return config.Config{
+		SyncLogMethodsSet: set.NewThreadUnsafeSetFromSlice([]interface{}{"PUT", "GET"}),
+		Synclog: &logrus.Logger{
+			Out:       buf,
+			Formatter: log.PlainTextFormatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.DebugLevel,
+		},
+	}
+}
+
+func mkTuple(method, host string, statusCode int, err error) transport.ReqResErrTuple {
+	req, _ := http.NewRequest(method, "http://"+host+"/bucket/key", nil)
+	req = req.WithContext(context.WithValue(context.Background(), log.ContextreqIDKey, "reqid"))
+	tup := transport.ReqResErrTuple{Req: req, Err: err, Failed: err != nil}
+	if err == nil {
+		tup.Res = &http.Response{
+			StatusCode: statusCode,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("body")),
+			Header:     make(http.Header),
+		}
+		tup.Failed = statusCode < 200 || statusCode > 399
+	}
+	return tup
+}
+
+func feed(tups ...transport.ReqResErrTuple) <-chan transport.ReqResErrTuple {
+	in := make(chan transport.ReqResErrTuple, len(tups))
+	for _, tup := range tups {
+		in <- tup
+	}
+	close(in)
+	return in
+}
+
+func TestQuorumResponseHandlerPassesWhenQuorumReached(t *testing.T) {
+	buf := &syncBuffer{}
+	handler := QuorumResponseHandler(mkSyncLogConfig(buf), 2)
+	res := handler(feed(
+		mkTuple("PUT", "b1", http.StatusOK, nil),
+		mkTuple("PUT", "b2", http.StatusInternalServerError, nil),
+		mkTuple("PUT", "b3", http.StatusOK, nil),
+	))
+	assert.NoError(t, res.Err)
+	assert.Equal(t, http.StatusOK, res.Res.StatusCode)
+}
+
+func TestQuorumResponseHandlerFailsWithoutQuorum(t *testing.T) {
+	buf := &syncBuffer{}
+	handler := QuorumResponseHandler(mkSyncLogConfig(buf), 2)
+	res := handler(feed(
+		mkTuple("PUT", "b1", http.StatusOK, nil),
+		mkTuple("PUT", "b2", 0, errors.New("connection reset")),
+		mkTuple("PUT", "b3", http.StatusInternalServerError, nil),
+	))
+	assert.Equal(t, ErrQuorumNotReached, res.Err)
+	assert.Nil(t, res.Res)
+}
+
+func TestQuorumResponseHandlerSynclogsMinorityFailures(t *testing.T) {
+	buf := &syncBuffer{}
+	handler := QuorumResponseHandler(mkSyncLogConfig(buf), 2)
+	in := make(chan transport.ReqResErrTuple, 3)
+	in <- mkTuple("PUT", "b1", http.StatusOK, nil)
+	in <- mkTuple("PUT", "b2", http.StatusOK, nil)
+	in <- mkTuple("PUT", "b3", 0, errors.New("connection reset"))
+	close(in)
+	res := handler(in)
+	assert.NoError(t, res.Err)
+	// synclog is written after response is passed
+	logged := false
+	for i := 0; i < 100 && !logged; i++ {
+		<-time.After(10 * time.Millisecond)
+		logged = buf.Contains(`"failedhost":"b3"`)
+	}
+	assert.True(t, logged, "Failed backend should be logged in synclog")
+}
+
+func TestQuorumResponseHandlerPassesFirstSuccessfulRead(t *testing.T) {
+	buf := &syncBuffer{}
+	handler := QuorumResponseHandler(mkSyncLogConfig(buf), 3)
+	res := handler(feed(
+		mkTuple("GET", "b1", http.StatusNotFound, nil),
+		mkTuple("GET", "b2", http.StatusOK, nil),
+	))
+	assert.NoError(t, res.Err)
+	assert.Equal(t, http.StatusOK, res.Res.StatusCode)
+}
+
+func mkTupleWithETag(host, etag string) transport.ReqResErrTuple {
+	tup := mkTuple("PUT", host, http.StatusOK, nil)
+	tup.Res.Header.Set("ETag", etag)
+	return tup
+}
+
+func TestChecksumMismatchIsLogged(t *testing.T) {
+	buf := &syncBuffer{}
+	conf := mkSyncLogConfig(buf)
+	conf.ReplicaChecksums.Enabled = true
+	handler := LateResponseHandler(conf)
+	res := handler(feed(
+		mkTupleWithETag("b1", `"abc"`),
+		mkTupleWithETag("b2", `"abc"`),
+		mkTupleWithETag("b3", `"def"`),
+	))
+	assert.NoError(t, res.Err)
+	assert.Equal(t, http.StatusOK, res.Res.StatusCode)
+	assert.True(t, buf.Contains("b3"), "Mismatched backend should be logged")
+	assert.False(t, buf.Contains("b2"), "Matching backend should not be logged")
+}
+
+func TestChecksumMismatchFailsStrictBucket(t *testing.T) {
+	buf := &syncBuffer{}
+	conf := mkSyncLogConfig(buf)
+	conf.ReplicaChecksums.Enabled = true
+	conf.ReplicaChecksums.StrictBuckets = []string{"bucket"}
+	for _, handler := range []transport.MultipleResponsesHandler{
+		EarliestResponseHandler(conf),
+		QuorumResponseHandler(conf, 1),
+	} {
+		res := handler(feed(
+			mkTupleWithETag("b1", `"abc"`),
+			mkTupleWithETag("b2", `"def"`),
+		))
+		assert.Equal(t, ErrReplicaChecksumMismatch, res.Err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/allegro/akubra/log"
 	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
 )
 
 // Decorator is http.RoundTripper interface wrapper
@@ -23,6 +24,7 @@ type loggingRoundTripper struct {
 func (lrt *loggingRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 
 	timeStart := time.Now()
+	req = req.WithContext(transport.WithRetriesCounter(req.Context()))
 	resp, err = lrt.roundTripper.RoundTrip(req)
 
 	duration := time.Since(timeStart).Seconds()
@@ -64,7 +66,6 @@ type headersSuplier struct {
 
 func (hs *headersSuplier) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 
-	req.URL.Scheme = "http"
 	for k, v := range hs.requestHeaders {
 		_, ok := req.Header[k]
 		if !ok {
@@ -72,15 +73,6 @@ func (hs *headersSuplier) RoundTrip(req *http.Request) (resp *http.Response, err
 		}
 	}
 
-	// While tcp host is rewritten we need to keep Host header
-	// intact for sake of s3 authorization
-	if strings.Contains(req.Host, ".s3.") {
-		prefix := strings.Split(req.Host, ".s3.")[0]
-		newhost := prefix + "." + req.URL.Host
-		req.Header.Set("Host", newhost)
-		req.Host = newhost
-	}
-
 	resp, err = hs.roundTripper.RoundTrip(req)
 
 	if err != nil {
@@ -131,9 +123,13 @@ func OptionsHandler(roundTripper http.RoundTripper) http.RoundTripper {
 	return optionsHandler{roundTripper: roundTripper}
 }
 
+// StatusChecker returns error if akubra should be reported unhealthy
+type StatusChecker func() error
+
 type statusHandler struct {
 	healthCheckEndpoint string
 	roundTripper        http.RoundTripper
+	checkers            []StatusChecker
 }
 
 func (sh statusHandler) RoundTrip(req *http.Request) (resp *http.Response, err error) {
@@ -141,23 +137,32 @@ func (sh statusHandler) RoundTrip(req *http.Request) (resp *http.Response, err e
 	if strings.ToLower(req.URL.Path) == sh.healthCheckEndpoint {
 		resp := &http.Response{}
 		bodyContent := "OK"
+		resp.StatusCode = http.StatusOK
+		for _, checker := range sh.checkers {
+			if checkErr := checker(); checkErr != nil {
+				bodyContent = checkErr.Error()
+				resp.StatusCode = http.StatusServiceUnavailable
+				break
+			}
+		}
 		resp.Body = ioutil.NopCloser(strings.NewReader(bodyContent))
 		resp.ContentLength = int64(len(bodyContent))
 		resp.Header = make(http.Header, 0)
 		resp.Header.Set("Cache-Control", "no-cache, no-store")
 		resp.Header.Set("Content-Type", "text/plain")
-		resp.StatusCode = http.StatusOK
 		return resp, nil
 	}
 	return sh.roundTripper.RoundTrip(req)
 }
 
-// HealthCheckHandler serving health check endpoint
-func HealthCheckHandler(healthCheckEndpoint string) Decorator {
+// HealthCheckHandler serving health check endpoint, responds with 503
+// if any of checkers returns error
+func HealthCheckHandler(healthCheckEndpoint string, checkers ...StatusChecker) Decorator {
 	return func(roundTripper http.RoundTripper) http.RoundTripper {
 		return &statusHandler{
 			healthCheckEndpoint: healthCheckEndpoint,
 			roundTripper:        roundTripper,
+			checkers:            checkers,
 		}
 	}
 }
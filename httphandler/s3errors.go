@@ -0,0 +1,113 @@
+package httphandler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/transport"
+)
+
+// S3Error is error response sent by akubra in format understood by S3
+// clients
+type S3Error struct {
+	XMLName    xml.Name `xml:"Error"`
+	StatusCode int      `xml:"-"`
+	Code       string   `xml:"Code"`
+	Message    string   `xml:"Message"`
+	Resource   string   `xml:"Resource,omitempty"`
+	RequestID  string   `xml:"RequestId"`
+}
+
+var (
+	// S3NoSuchBucket is returned if no region serves requested domain
+	S3NoSuchBucket = S3Error{StatusCode: http.StatusNotFound, Code: "NoSuchBucket", Message: "The specified bucket does not exist."}
+	// S3SlowDown is returned if akubra or backends are overloaded
+	S3SlowDown = S3Error{StatusCode: http.StatusServiceUnavailable, Code: "SlowDown", Message: "Please reduce your request rate."}
+	// S3InternalError is returned if request failed for other reasons
+	S3InternalError = S3Error{StatusCode: http.StatusInternalServerError, Code: "InternalError", Message: "We encountered an internal error. Please try again."}
+	// S3EntityTooLarge is returned if request body exceeds BodyMaxSize
+	S3EntityTooLarge = S3Error{StatusCode: http.StatusRequestEntityTooLarge, Code: "EntityTooLarge", Message: "Your proposed upload exceeds the maximum allowed size."}
+	// S3AccessDenied is returned if client signature is invalid
+	S3AccessDenied = S3Error{StatusCode: http.StatusForbidden, Code: "AccessDenied", Message: "Access Denied."}
+	// S3InvalidArgument is returned for malformed requests
+	S3InvalidArgument = S3Error{StatusCode: http.StatusBadRequest, Code: "InvalidArgument", Message: "Invalid Argument."}
+)
+
+// WithMessage returns copy of error with given message
+func (s3Err S3Error) WithMessage(message string) S3Error {
+	s3Err.Message = message
+	return s3Err
+}
+
+// s3ErrorFor maps error returned by round tripper to S3 error
+func s3ErrorFor(err error) S3Error {
+	switch err {
+	case ErrBodyTooLarge:
+		return S3EntityTooLarge
+	case transport.ErrBulkheadFull, transport.ErrCircuitOpen, transport.ErrBackendUnavailable,
+		transport.ErrSpillSpaceExhausted, transport.ErrSlowBackend:
+		return S3SlowDown
+	}
+	return S3InternalError
+}
+
+// s3ErrorForStatus maps request validation status to S3 error
+func s3ErrorForStatus(statusCode int) S3Error {
+	switch statusCode {
+	case http.StatusRequestEntityTooLarge:
+		return S3EntityTooLarge
+	case http.StatusBadRequest:
+		return S3InvalidArgument
+	}
+	s3Err := S3InternalError
+	s3Err.StatusCode = statusCode
+	return s3Err
+}
+
+func (s3Err S3Error) body(req *http.Request, reqID string) []byte {
+	s3Err.RequestID = reqID
+	if req != nil && req.URL != nil {
+		s3Err.Resource = req.URL.Path
+	}
+	content, err := xml.Marshal(s3Err)
+	if err != nil {
+		log.Printf("Cannot marshal %s error: %s", s3Err.Code, err)
+	}
+	return append([]byte(xml.Header), content...)
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, reqID string, s3Err S3Error) {
+	body := s3Err.body(req, reqID)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("x-amz-request-id", reqID)
+	w.WriteHeader(s3Err.StatusCode)
+	if _, err := w.Write(body); err != nil {
+		log.Printf("Cannot send %s error response: %s", s3Err.Code, err)
+	}
+}
+
+// S3ErrorResponse creates response with S3 error, request id is taken
+// from request context
+func S3ErrorResponse(req *http.Request, s3Err S3Error) *http.Response {
+	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+	body := s3Err.body(req, reqID)
+	header := make(http.Header)
+	header.Set("Content-Type", "application/xml")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	header.Set("x-amz-request-id", reqID)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", s3Err.StatusCode, http.StatusText(s3Err.StatusCode)),
+		StatusCode:    s3Err.StatusCode,
+		Proto:         req.Proto,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+		Header:        header,
+	}
+}
@@ -0,0 +1,86 @@
+package httphandler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const defaultReloadInterval = 10 * time.Second
+
+// watchedFile is configuration file read again when its modification time
+// or size changes
+type watchedFile struct {
+	path     string
+	interval time.Duration
+	mx       sync.Mutex
+	loaded   bool
+	modTime  time.Time
+	size     int64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newWatchedFile creates watchedFile, zero interval means default interval
+// of file changes checks
+func newWatchedFile(path string, interval time.Duration) *watchedFile {
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	return &watchedFile{path: path, interval: interval, stop: make(chan struct{})}
+}
+
+// reload passes file content to parse if file changed since last
+// successful parse
+func (wf *watchedFile) reload(parse func(content []byte) error) error {
+	wf.mx.Lock()
+	defer wf.mx.Unlock()
+	info, err := os.Stat(wf.path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", wf.path, err)
+	}
+	if wf.loaded && info.ModTime().Equal(wf.modTime) && info.Size() == wf.size {
+		return nil
+	}
+	content, err := ioutil.ReadFile(wf.path)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", wf.path, err)
+	}
+	if err := parse(content); err != nil {
+		return fmt.Errorf("cannot parse %s: %s", wf.path, err)
+	}
+	wf.loaded = true
+	wf.modTime = info.ModTime()
+	wf.size = info.Size()
+	return nil
+}
+
+// start calls reload in background, failures are reported with name
+// prefixed metric
+func (wf *watchedFile) start(name string, reload func() error) {
+	go func() {
+		ticker := time.NewTicker(wf.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := reload(); err != nil {
+					metrics.Mark(name + ".reload.failure")
+					log.Printf("Keeping previous %s configuration: %s", name, err)
+				}
+			case <-wf.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close terminates file changes checks
+func (wf *watchedFile) close() {
+	wf.stopOnce.Do(func() { close(wf.stop) })
+}
@@ -17,6 +17,10 @@ type ContextKey string
 const (
 	// ContextreqIDKey is Request Context Value key for debug logging
 	ContextreqIDKey = ContextKey("ContextreqIDKey")
+	// ContextRetriesKey is Request Context Value key for backend retries counter
+	ContextRetriesKey = ContextKey("ContextRetriesKey")
+	// ContextClientKey is Request Context Value key for authenticated client
+	ContextClientKey = ContextKey("ContextClientKey")
 )
 
 // SyslogFacilityMap is string map of facilities
@@ -45,6 +45,16 @@ func Time(name string, function func()) {
 	timer.Time(function)
 }
 
+// TimerPercentile returns percentile (0-1] of Timer sample, zero if Timer
+// is not registered
+func TimerPercentile(name string, percentile float64) float64 {
+	timer, ok := metrics.DefaultRegistry.Get(name).(metrics.Timer)
+	if !ok {
+		return 0
+	}
+	return timer.Percentile(percentile)
+}
+
 // UpdateGauge changes Gauge value
 func UpdateGauge(name string, value int64) {
 	gauge := metrics.GetOrRegisterGauge(name, metrics.DefaultRegistry)
@@ -1,47 +1,44 @@
 package regions
 
 import (
-	"bytes"
-	"io/ioutil"
-	"net"
+	"fmt"
 	"net/http"
 
 	"github.com/allegro/akubra/config"
 	"github.com/allegro/akubra/httphandler"
 	"github.com/allegro/akubra/sharding"
 	"github.com/allegro/akubra/storages"
+	"github.com/allegro/akubra/transport"
 )
 
 //Regions container for multiclusters
 type Regions struct {
 	multiCluters map[string]sharding.ShardsRingAPI
 	defaultRing  sharding.ShardsRingAPI
+	// domains of all regions, used for virtual-hosted requests parsing
+	domains []string
 }
 
-func (rg Regions) assignShardsRing(domain string, shardRing sharding.ShardsRingAPI) {
+func (rg *Regions) assignShardsRing(domain string, shardRing sharding.ShardsRingAPI) {
 	rg.multiCluters[domain] = shardRing
+	rg.domains = append(rg.domains, domain)
 }
 
 func (rg Regions) getNoSuchDomainResponse(req *http.Request) *http.Response {
-	body := "No region found for this domain."
-	return &http.Response{
-		Status:        "404 Not found",
-		StatusCode:    404,
-		Proto:         req.Proto,
-		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
-		ContentLength: int64(len(body)),
-		Request:       req,
-		Header:        make(http.Header, 0),
-	}
+	return httphandler.S3ErrorResponse(req, httphandler.S3NoSuchBucket.WithMessage("No region found for this domain."))
 }
 
 //RoundTrip performs round trip to target
 func (rg Regions) RoundTrip(req *http.Request) (*http.Response, error) {
-	reqHost, _, err := net.SplitHostPort(req.Host)
-	if err != nil {
-		reqHost = req.Host
+	path := ""
+	if req.URL != nil {
+		path = req.URL.Path
 	}
-	shardsRing, ok := rg.multiCluters[reqHost]
+	address := transport.ParseS3Address(req.Host, path, rg.domains)
+	if address.VirtualHosted {
+		req = pathStyleRequest(req, address)
+	}
+	shardsRing, ok := rg.multiCluters[address.Domain]
 	if ok {
 		return shardsRing.DoRequest(req)
 	}
@@ -51,16 +48,71 @@ func (rg Regions) RoundTrip(req *http.Request) (*http.Response, error) {
 	return rg.getNoSuchDomainResponse(req), nil
 }
 
+// pathStyleRequest returns copy of virtual-hosted request with bucket moved
+// to path, so requests are sharded and sent to backends the same way
+// regardless of client addressing style
+func pathStyleRequest(req *http.Request, address transport.S3Address) *http.Request {
+	pathStyle := req.WithContext(req.Context())
+	reqURL := *req.URL
+	reqURL.Path = address.Path()
+	reqURL.RawPath = ""
+	if escapedPath := req.URL.EscapedPath(); escapedPath != "" && escapedPath != "/" {
+		reqURL.RawPath = "/" + address.Bucket + escapedPath
+	}
+	pathStyle.URL = &reqURL
+	pathStyle.Host = address.Domain
+	return pathStyle
+}
+
+// regionsReachable reports error if every backend of any region
+// fails health checks
+func regionsReachable(conf config.Config, health *transport.HealthChecker) httphandler.StatusChecker {
+	regionHosts := make(map[string][]string, len(conf.Regions))
+	for regionName, regionConfig := range conf.Regions {
+		for _, clusterConfig := range regionConfig.Clusters {
+			for _, backend := range conf.Clusters[clusterConfig.Cluster].Backends {
+				regionHosts[regionName] = append(regionHosts[regionName], backend.Host)
+			}
+		}
+	}
+	return func() error {
+		for regionName, hosts := range regionHosts {
+			if !health.AnyAvailable(hosts) {
+				return fmt.Errorf("All backends of region %s are unavailable", regionName)
+			}
+		}
+		return nil
+	}
+}
+
 //NewHandler build new region handler
 func NewHandler(conf config.Config) (http.Handler, error) {
 	httptransp, err := httphandler.ConfigureHTTPTransport(conf)
 	if err != nil {
 		return nil, err
 	}
+	spill, err := storages.NewBodySpill(conf)
+	if err != nil {
+		return nil, err
+	}
+	replication, err := storages.NewReplicationQueue(conf)
+	if err != nil {
+		return nil, err
+	}
+	multipart, err := storages.NewMultipartUploads(conf)
+	if err != nil {
+		return nil, err
+	}
 	allStorages := &storages.Storages{
-		Conf:      conf,
-		Transport: httptransp,
-		Clusters:  make(map[string]storages.Cluster),
+		Conf:        conf,
+		Transport:   httptransp,
+		Clusters:    make(map[string]storages.Cluster),
+		Breakers:    storages.NewCircuitBreakers(conf),
+		Health:      storages.NewHealthChecker(conf),
+		Spill:       spill,
+		Bulkheads:   storages.NewBulkheads(conf),
+		Replication: replication,
+		Multipart:   multipart,
 	}
 	ringFactory := sharding.NewRingFactory(conf, allStorages, httptransp)
 	regions := &Regions{
@@ -79,6 +131,31 @@ func NewHandler(conf config.Config) (http.Handler, error) {
 			regions.defaultRing = regionRing
 		}
 	}
-	roundTripper := httphandler.DecorateRoundTripper(conf, regions)
+	if allStorages.Replication != nil {
+		allStorages.Replication.Start()
+	}
+	if allStorages.Multipart != nil {
+		allStorages.Multipart.Start()
+	}
+	var statusCheckers []httphandler.StatusChecker
+	if allStorages.Health != nil {
+		allStorages.Health.Start()
+		statusCheckers = append(statusCheckers, regionsReachable(conf, allStorages.Health))
+	}
+	credentials, err := httphandler.NewCredentialStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	if credentials != nil {
+		credentials.Start()
+	}
+	policies, err := httphandler.NewPolicyStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	if policies != nil {
+		policies.Start()
+	}
+	roundTripper := httphandler.DecorateRoundTripper(conf, regions, credentials, policies, statusCheckers...)
 	return httphandler.NewHandlerWithRoundTripper(roundTripper, conf.BodyMaxSize.SizeInBytes, conf.MaxConcurrentRequests)
 }
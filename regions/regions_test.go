@@ -1,10 +1,17 @@
 package regions
 
 import (
+	"context"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"testing"
 
+	"github.com/allegro/akubra/config"
+	"github.com/allegro/akubra/log"
 	"github.com/allegro/akubra/sharding"
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/transport"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -33,6 +40,20 @@ func TestCode404OnNotSupportedDomain(t *testing.T) {
 	assert.Equal(t, 404, response.StatusCode)
 }
 
+func TestNotSupportedDomainResponseIsS3Error(t *testing.T) {
+	regions := &Regions{multiCluters: make(map[string]sharding.ShardsRingAPI)}
+	request := &http.Request{Host: "test2.qxlint", URL: &url.URL{Path: "/bucket/object"}}
+	request = request.WithContext(context.WithValue(request.Context(), log.ContextreqIDKey, "reqid"))
+
+	response, _ := regions.RoundTrip(request)
+
+	body, err := ioutil.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/xml", response.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), "<Code>NoSuchBucket</Code>")
+	assert.Contains(t, string(body), "<RequestId>reqid</RequestId>")
+}
+
 func TestShouldReturnResponseFromShardsRing(t *testing.T) {
 	shardsMap := make(map[string]sharding.ShardsRingAPI)
 	regions := &Regions{
@@ -60,6 +81,24 @@ func TestShouldReturnResponseFromShardsRing(t *testing.T) {
 	shardsRingMock.AssertCalled(t, "DoRequest", request2)
 }
 
+func TestVirtualHostedRequestIsSentToRegionInPathStyle(t *testing.T) {
+	regions := &Regions{multiCluters: make(map[string]sharding.ShardsRingAPI)}
+	request := &http.Request{Host: "my.bucket.s3.qxlint:8080", URL: &url.URL{Path: "/dir/a/b", RawPath: "/dir/a%2Fb"}}
+	expectedResponse := &http.Response{Status: "200 OK", StatusCode: 200}
+	shardsRingMock := &ShardsRingMock{}
+	pathStyle := mock.MatchedBy(func(req *http.Request) bool {
+		return req.Host == "s3.qxlint" && req.URL.Path == "/my.bucket/dir/a/b" && req.URL.EscapedPath() == "/my.bucket/dir/a%2Fb"
+	})
+	shardsRingMock.On("DoRequest", pathStyle).Return(expectedResponse)
+	regions.assignShardsRing("s3.qxlint", shardsRingMock)
+
+	response, _ := regions.RoundTrip(request)
+
+	assert.Equal(t, 200, response.StatusCode)
+	shardsRingMock.AssertCalled(t, "DoRequest", pathStyle)
+	assert.Equal(t, "my.bucket.s3.qxlint:8080", request.Host, "client request shouldn't be changed")
+}
+
 func TestShouldReturnResponseFromShardsRingOnHostWithPort(t *testing.T) {
 	shardsMap := make(map[string]sharding.ShardsRingAPI)
 	regions := &Regions{
@@ -78,3 +117,22 @@ func TestShouldReturnResponseFromShardsRingOnHostWithPort(t *testing.T) {
 
 	assert.Equal(t, 200, response.StatusCode)
 }
+
+func TestRegionsReachableReportsRegionWithoutAvailableBackends(t *testing.T) {
+	backendURL, _ := url.Parse("http://127.0.0.1:1")
+	conf := config.Config{YamlConfig: config.YamlConfig{
+		Clusters: map[string]shardingconfig.ClusterConfig{
+			"cluster1": {Backends: []shardingconfig.YAMLUrl{{URL: backendURL}}},
+		},
+		Regions: map[string]shardingconfig.RegionConfig{
+			"region1": {Clusters: []shardingconfig.MultiClusterConfig{{Cluster: "cluster1", Weight: 1}}},
+		},
+	}}
+	health := transport.NewHealthChecker(transport.HealthCheckConfig{FailureThreshold: 1})
+	checker := regionsReachable(conf, health)
+	assert.NoError(t, checker())
+
+	health.AddBackends(http.DefaultTransport, []url.URL{*backendURL})
+	health.CheckAll()
+	assert.Error(t, checker())
+}
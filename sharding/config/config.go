@@ -7,6 +7,7 @@ import (
 
 	"errors"
 
+	"github.com/allegro/akubra/metrics"
 	units "github.com/docker/go-units"
 )
 
@@ -14,6 +15,83 @@ import (
 type ClusterConfig struct {
 	// Backends should contain s3 backend urls
 	Backends []YAMLUrl `yaml:"Backends"`
+	// WriteQuorum is number of backends which have to succeed for
+	// write request to be successful, default 0 (first success wins)
+	WriteQuorum int `yaml:"WriteQuorum,omitempty"`
+	// ReadPolicy sends GET and HEAD requests to single backend with
+	// failover, one of "round-robin", "least-latency", "preferred-zone".
+	// Default "" sends reads to all backends
+	ReadPolicy string `yaml:"ReadPolicy,omitempty" validate:"regexp=^(round-robin|least-latency|preferred-zone)?$"`
+	// PreferredZone is zone read first by "preferred-zone" policy
+	PreferredZone string `yaml:"PreferredZone,omitempty"`
+	// BackendZones maps backend host (with port) to zone name
+	BackendZones map[string]string `yaml:"BackendZones,omitempty"`
+	// Transport overrides global http transport settings for cluster
+	Transport TransportConfig `yaml:"Transport,omitempty"`
+	// BackendTransports overrides cluster transport settings for backend
+	// host (with port)
+	BackendTransports map[string]TransportConfig `yaml:"BackendTransports,omitempty"`
+	// AsyncReplication acknowledges writes after first backend succeeds,
+	// other backends get them from replication queue. Requires global
+	// AsyncReplication to be enabled
+	AsyncReplication bool `yaml:"AsyncReplication,omitempty"`
+	// RequestProcessors change requests sent to cluster backends, in order
+	RequestProcessors []RequestProcessorConfig `yaml:"RequestProcessors,omitempty"`
+	// Credentials re-sign requests sent to cluster backends, client
+	// signature is passed unchanged if not set
+	Credentials CredentialsConfig `yaml:"Credentials,omitempty"`
+	// AddressingStyle of requests sent to cluster backends, path (default)
+	// or virtual-hosted
+	AddressingStyle string `yaml:"AddressingStyle,omitempty" validate:"regexp=^(path|virtual-hosted)?$"`
+}
+
+// CredentialsConfig defines backend access keys
+type CredentialsConfig struct {
+	AccessKey string `yaml:"AccessKey,omitempty"`
+	SecretKey string `yaml:"SecretKey,omitempty"`
+	// Region in V4 signature scope, default us-east-1
+	Region string `yaml:"Region,omitempty"`
+}
+
+// TransportConfig overrides http transport settings, zero values keep
+// global settings. See: https://golang.org/pkg/net/http/#Transport
+type TransportConfig struct {
+	// DialTimeout limits time of establishing connection
+	DialTimeout metrics.Interval `yaml:"DialTimeout,omitempty"`
+	// ResponseHeaderTimeout limits time of waiting for response headers
+	ResponseHeaderTimeout metrics.Interval `yaml:"ResponseHeaderTimeout,omitempty"`
+	// MaxIdleConns limits idle connections to all hosts
+	MaxIdleConns int `yaml:"MaxIdleConns,omitempty" validate:"min=0"`
+	// MaxIdleConnsPerHost limits idle connections to single host
+	MaxIdleConnsPerHost int `yaml:"MaxIdleConnsPerHost,omitempty" validate:"min=0"`
+	// IdleConnTimeout closes connections idle for longer time
+	IdleConnTimeout metrics.Interval `yaml:"IdleConnTimeout,omitempty"`
+	// MaxConnsPerHost limits all connections to single host
+	MaxConnsPerHost int `yaml:"MaxConnsPerHost,omitempty" validate:"min=0"`
+	// DisableKeepAlives if set, overrides global DisableKeepAlives
+	DisableKeepAlives *bool `yaml:"DisableKeepAlives,omitempty"`
+	// TLS if set, overrides global backend TLS settings
+	TLS *TLSConfig `yaml:"TLS,omitempty"`
+}
+
+// TLSConfig configures TLS connections to https:// backends
+type TLSConfig struct {
+	// CAFile is PEM encoded CA bundle, system roots are used if empty
+	CAFile string `yaml:"CAFile,omitempty"`
+	// CertFile is PEM encoded client certificate used for mutual TLS
+	CertFile string `yaml:"CertFile,omitempty"`
+	// KeyFile is PEM encoded client certificate key
+	KeyFile string `yaml:"KeyFile,omitempty"`
+	// ServerName overrides SNI and name verified in backend certificate
+	ServerName string `yaml:"ServerName,omitempty"`
+	// InsecureSkipVerify disables backend certificate verification,
+	// never use it in production
+	InsecureSkipVerify bool `yaml:"InsecureSkipVerify,omitempty"`
+}
+
+// IsEmpty reports if TransportConfig overrides no settings
+func (tc TransportConfig) IsEmpty() bool {
+	return tc == TransportConfig{}
 }
 
 // MultiClusterConfig defines region settings for multicluster
@@ -32,6 +110,28 @@ type RegionConfig struct {
 	Domains []string `yaml:"Domains"`
 	// Default region will be applied if Host header would not match any other region
 	Default bool `yaml:"Default,omitempty"`
+	// WriteQuorum is number of region backends which have to succeed for
+	// bucket write requests, default 0 (first success wins)
+	WriteQuorum int `yaml:"WriteQuorum,omitempty"`
+	// RequestProcessors change requests sent to region backends, in order,
+	// before cluster processors
+	RequestProcessors []RequestProcessorConfig `yaml:"RequestProcessors,omitempty"`
+}
+
+// RequestProcessorConfig defines built-in processor changing backend
+// requests
+type RequestProcessorConfig struct {
+	// Type is one of set-headers, remove-headers, rewrite-path-prefix,
+	// strip-query-params
+	Type string `yaml:"Type" validate:"regexp=^(set-headers|remove-headers|rewrite-path-prefix|strip-query-params)$"`
+	// Headers set by set-headers
+	Headers map[string]string `yaml:"Headers,omitempty"`
+	// Names of headers removed by remove-headers or query parameters
+	// removed by strip-query-params
+	Names []string `yaml:"Names,omitempty"`
+	// From path prefix replaced with To by rewrite-path-prefix
+	From string `yaml:"From,omitempty"`
+	To   string `yaml:"To,omitempty"`
 }
 
 // YAMLUrl type fields in yaml configuration will parse urls
@@ -52,6 +152,147 @@ type HumanSizeUnits struct {
 	SizeInBytes int64
 }
 
+// BodyStreamingConfig enables request body streaming to backends
+type BodyStreamingConfig struct {
+	// Stream bodies instead of buffering them in memory
+	Enabled bool `yaml:"Enabled"`
+	// Size of single chunk read from client, default 32k
+	ChunkSize HumanSizeUnits `yaml:"ChunkSize,omitempty"`
+	// Number of chunks buffered per backend, default 16
+	QueueLength int `yaml:"QueueLength,omitempty" validate:"min=0"`
+	// How long to wait for slow backend before it's dropped, default 1s
+	SlowBackendTimeout metrics.Interval `yaml:"SlowBackendTimeout,omitempty"`
+}
+
+// BodySpillConfig enables buffering large request bodies on disk
+type BodySpillConfig struct {
+	// Spill bodies larger than Threshold to temporary files
+	Enabled bool `yaml:"Enabled"`
+	// Body size above which body is written to disk, default 0 (all bodies)
+	Threshold HumanSizeUnits `yaml:"Threshold,omitempty"`
+	// Temporary files directory, required, must not be shared
+	Dir string `yaml:"Dir,omitempty"`
+	// Total size of spilled bodies, default 0 (no limit)
+	MaxSize HumanSizeUnits `yaml:"MaxSize,omitempty"`
+}
+
+// AsyncReplicationConfig configures durable queue of writes replicated
+// to backends in background
+type AsyncReplicationConfig struct {
+	// Enable replication queue, clusters opt in with AsyncReplication
+	Enabled bool `yaml:"Enabled"`
+	// Queue directory, jobs found there are resumed after restart
+	Dir string `yaml:"Dir,omitempty"`
+	// Number of jobs replicated in parallel, default 4
+	Workers int `yaml:"Workers,omitempty"`
+	// Attempts after which write is dropped and logged to synclog, default 10
+	MaxAttempts int `yaml:"MaxAttempts,omitempty"`
+	// Wait between job attempts, default 10s
+	RetryInterval metrics.Interval `yaml:"RetryInterval,omitempty"`
+}
+
+// MultipartUploadsConfig configures coordination of multipart uploads
+// across backends
+type MultipartUploadsConfig struct {
+	// Issue own upload ids mapped to upload ids of backends
+	Enabled bool `yaml:"Enabled"`
+	// Directory storing upload ids mapping
+	Dir string `yaml:"Dir,omitempty"`
+	// Uploads older than UploadTTL are aborted on backends, default 0
+	// (never)
+	UploadTTL metrics.Interval `yaml:"UploadTTL,omitempty"`
+}
+
+// ClientAuthConfig configures verification of client request signatures
+type ClientAuthConfig struct {
+	// Verify client signatures, unsigned requests are rejected
+	Enabled bool `yaml:"Enabled"`
+	// YAML file with client access keys, secret keys and tenants
+	CredentialsFile string `yaml:"CredentialsFile,omitempty"`
+	// Interval of credentials file changes checks, default 10s
+	ReloadInterval metrics.Interval `yaml:"ReloadInterval,omitempty"`
+}
+
+// AccessPoliciesConfig configures authorization of client requests
+type AccessPoliciesConfig struct {
+	// Allow clients only operations listed in PolicyFile, requires
+	// ClientAuth
+	Enabled bool `yaml:"Enabled"`
+	// YAML file with buckets, prefixes and operations allowed to access keys
+	PolicyFile string `yaml:"PolicyFile,omitempty"`
+	// Interval of policy file changes checks, default 10s
+	ReloadInterval metrics.Interval `yaml:"ReloadInterval,omitempty"`
+}
+
+// ReplicaChecksumsConfig configures comparison of checksums returned by
+// backends on PUT requests
+type ReplicaChecksumsConfig struct {
+	// Compare ETag and x-amz-checksum-* headers, mismatches are logged
+	Enabled bool `yaml:"Enabled"`
+	// Buckets for which client gets an error on mismatch, response is
+	// passed once all backends respond
+	StrictBuckets []string `yaml:"StrictBuckets,omitempty"`
+}
+
+// CircuitBreakerConfig configures per backend circuit breakers
+type CircuitBreakerConfig struct {
+	// Enable circuit breakers
+	Enabled bool `yaml:"Enabled"`
+	// Ratio of failed requests (0-1] in Window which opens breaker, default 0.5
+	ErrorRate *float64 `yaml:"ErrorRate,omitempty" validate:"ErrorRate"`
+	// Requests slower than LatencyThreshold are counted as failed, default 0 (disabled)
+	LatencyThreshold metrics.Interval `yaml:"LatencyThreshold,omitempty"`
+	// Number of requests in Window required to evaluate ErrorRate, default 10
+	MinRequests int `yaml:"MinRequests,omitempty" validate:"min=0"`
+	// Length of period in which requests are counted, default 10s
+	Window metrics.Interval `yaml:"Window,omitempty"`
+	// How long breaker stays open before probe requests are sent, default 30s
+	OpenDuration metrics.Interval `yaml:"OpenDuration,omitempty"`
+	// Number of successful probes required to close breaker, default 1
+	HalfOpenProbes int `yaml:"HalfOpenProbes,omitempty" validate:"min=0"`
+}
+
+// HealthCheckConfig configures active backend health checking
+type HealthCheckConfig struct {
+	// Enable health checking
+	Enabled bool `yaml:"Enabled"`
+	// Path requested on every backend, default "/"
+	Path string `yaml:"Path,omitempty"`
+	// Interval between probes, default 5s
+	Interval metrics.Interval `yaml:"Interval,omitempty"`
+	// Timeout of single probe, default 2s
+	Timeout metrics.Interval `yaml:"Timeout,omitempty"`
+	// Consecutive failed probes which mark backend unavailable, default 3
+	FailureThreshold int `yaml:"FailureThreshold,omitempty" validate:"min=0"`
+	// Consecutive successful probes which mark backend available, default 2
+	SuccessThreshold int `yaml:"SuccessThreshold,omitempty" validate:"min=0"`
+}
+
+// HedgedReadsConfig configures hedged GET requests
+type HedgedReadsConfig struct {
+	// Enable hedged reads
+	Enabled bool `yaml:"Enabled"`
+	// Delay after which GET is repeated on second backend, default 100ms
+	Delay metrics.Interval `yaml:"Delay,omitempty"`
+	// Percentile (0-1] of first backend latency used as delay instead of
+	// fixed Delay, default 0 (disabled)
+	Percentile float64 `yaml:"Percentile,omitempty" validate:"min=0,max=1"`
+}
+
+// RetryConfig configures retries of idempotent backend requests
+type RetryConfig struct {
+	// Enable retries
+	Enabled bool `yaml:"Enabled"`
+	// Total number of attempts, including first one, default 3
+	MaxAttempts int `yaml:"MaxAttempts,omitempty" validate:"min=0"`
+	// Wait time before first retry, doubled on next ones, default 50ms
+	InitialBackoff metrics.Interval `yaml:"InitialBackoff,omitempty"`
+	// Maximal wait time between attempts, default 1s
+	MaxBackoff metrics.Interval `yaml:"MaxBackoff,omitempty"`
+	// Total time spent on all attempts, default 5s
+	Budget metrics.Interval `yaml:"Budget,omitempty"`
+}
+
 // UnmarshalYAML for YAMLUrl
 func (yurl *YAMLUrl) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
@@ -0,0 +1,410 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/allegro/akubra/httphandler"
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/storages"
+)
+
+const (
+	defaultMaxKeys = 1000
+	// maxListingSize limits size of listing read from cluster, 1000 keys
+	// with maximal length fit in it
+	maxListingSize = 32 << 20
+	s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+)
+
+// listingParams are query parameters of ListObjects, other parameters
+// select bucket subresources
+var listingParams = map[string]bool{
+	"prefix":             true,
+	"delimiter":          true,
+	"marker":             true,
+	"max-keys":           true,
+	"encoding-type":      true,
+	"list-type":          true,
+	"continuation-token": true,
+	"start-after":        true,
+	"fetch-owner":        true,
+}
+
+// isListObjectsRequest reports if request to bucket path lists bucket
+// objects
+func isListObjectsRequest(req *http.Request) bool {
+	if req.Method != http.MethodGet || strings.Trim(req.URL.Path, "/") == "" {
+		return false
+	}
+	for param := range req.URL.Query() {
+		if !listingParams[param] {
+			return false
+		}
+	}
+	return true
+}
+
+// listingEntry is object or common prefix of listing
+type listingEntry struct {
+	// key is used for ordering, it's decoded if listing is url encoded
+	key string
+	// name is key or prefix as returned by cluster
+	name     string
+	prefix   bool
+	innerXML string
+}
+
+type listedObject struct {
+	Key      string `xml:"Key"`
+	InnerXML string `xml:",innerxml"`
+}
+
+type listedPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName        xml.Name       `xml:"ListBucketResult"`
+	Name           string         `xml:"Name"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Contents       []listedObject `xml:"Contents"`
+	CommonPrefixes []listedPrefix `xml:"CommonPrefixes"`
+}
+
+type innerXML struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type mergedListBucketResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []innerXML     `xml:"Contents"`
+	CommonPrefixes        []listedPrefix `xml:"CommonPrefixes"`
+}
+
+// clusterListing is listing page returned by single cluster
+type clusterListing struct {
+	name      string
+	resp      *http.Response
+	err       error
+	result    listBucketResult
+	entries   []listingEntry
+	truncated bool
+	// last is greatest key or prefix returned by cluster
+	last listingEntry
+}
+
+// listing describes ListObjects request sent by client
+type listing struct {
+	v2           bool
+	prefix       string
+	delimiter    string
+	encodingType string
+	maxKeys      int
+	// marker, continuation token and start after are given by client
+	marker            string
+	continuationToken string
+	startAfter        string
+	// after is key after which listing starts
+	after string
+}
+
+func parseListing(query url.Values) (listing, error) {
+	l := listing{
+		v2:                query.Get("list-type") == "2",
+		prefix:            query.Get("prefix"),
+		delimiter:         query.Get("delimiter"),
+		encodingType:      query.Get("encoding-type"),
+		maxKeys:           defaultMaxKeys,
+		marker:            query.Get("marker"),
+		continuationToken: query.Get("continuation-token"),
+		startAfter:        query.Get("start-after"),
+	}
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		parsed, err := strconv.Atoi(maxKeys)
+		if err != nil || parsed < 0 {
+			return l, fmt.Errorf("invalid max-keys %q", maxKeys)
+		}
+		if parsed < defaultMaxKeys {
+			l.maxKeys = parsed
+		}
+	}
+	if !l.v2 {
+		l.after = l.marker
+		return l, nil
+	}
+	l.after = l.startAfter
+	if l.continuationToken != "" {
+		// token takes precedence, it may point to common prefix lower than
+		// start after, when keys after it were rolled up into the prefix
+		key, err := base64.RawURLEncoding.DecodeString(l.continuationToken)
+		if err != nil {
+			return l, fmt.Errorf("invalid continuation token")
+		}
+		l.after = string(key)
+	}
+	return l, nil
+}
+
+// clusterRequest makes request listing objects after l.after, continuation
+// tokens are issued by akubra so they're replaced by start-after
+func (l listing) clusterRequest(req *http.Request) (*http.Request, error) {
+	clusterReq, err := copyRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	query := clusterReq.URL.Query()
+	if l.v2 {
+		query.Del("continuation-token")
+		query.Del("start-after")
+		if l.after != "" {
+			query.Set("start-after", l.after)
+		}
+	}
+	clusterReq.URL.RawQuery = query.Encode()
+	return clusterReq, nil
+}
+
+func (l listing) entryKey(name string) string {
+	if l.encodingType != "url" {
+		return name
+	}
+	key, err := url.QueryUnescape(name)
+	if err != nil {
+		return name
+	}
+	return key
+}
+
+// entries returns sorted objects and prefixes of cluster listing placed
+// after l.after and greatest entry of listing
+func (l listing) entries(result listBucketResult) ([]listingEntry, listingEntry) {
+	entries := make([]listingEntry, 0, len(result.Contents)+len(result.CommonPrefixes))
+	for _, object := range result.Contents {
+		entries = append(entries, listingEntry{key: l.entryKey(object.Key), name: object.Key, innerXML: object.InnerXML})
+	}
+	for _, prefix := range result.CommonPrefixes {
+		entries = append(entries, listingEntry{key: l.entryKey(prefix.Prefix), name: prefix.Prefix, prefix: true})
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	last := listingEntry{}
+	if len(entries) > 0 {
+		last = entries[len(entries)-1]
+	}
+	after := entries[:0]
+	for _, entry := range entries {
+		if entry.key > l.after {
+			after = append(after, entry)
+		}
+	}
+	return after, last
+}
+
+// merge returns up to maxKeys first entries of all listings and entry
+// next page starts after, nil if listing isn't truncated. Truncated
+// cluster listing may be followed by keys lower than keys of other
+// clusters, so entries past last entry of any truncated listing are left
+// for next page. Page may be empty if truncated listing has no entries
+// after l.after, e.g. they are rolled up into common prefix.
+func (l listing) merge(listings []*clusterListing) ([]listingEntry, *listingEntry) {
+	entries := []listingEntry{}
+	if l.maxKeys == 0 {
+		return entries, nil
+	}
+	var bound *listingEntry
+	merged := []listingEntry{}
+	for _, cl := range listings {
+		merged = append(merged, cl.entries...)
+		if !cl.truncated {
+			continue
+		}
+		last := cl.last
+		if bound == nil || last.key < bound.key {
+			bound = &last
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].key < merged[j].key })
+	for _, entry := range merged {
+		if bound != nil && entry.key > bound.key {
+			break
+		}
+		// the same key may be stored in many clusters
+		if len(entries) > 0 && entries[len(entries)-1].key == entry.key {
+			continue
+		}
+		if len(entries) == l.maxKeys {
+			return entries, &entries[len(entries)-1]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, bound
+}
+
+func (l listing) result(bucket string, entries []listingEntry, next *listingEntry) mergedListBucketResult {
+	result := mergedListBucketResult{
+		Xmlns:          s3XMLNamespace,
+		Name:           bucket,
+		Prefix:         l.prefix,
+		MaxKeys:        l.maxKeys,
+		Delimiter:      l.delimiter,
+		EncodingType:   l.encodingType,
+		IsTruncated:    next != nil,
+		Contents:       []innerXML{},
+		CommonPrefixes: []listedPrefix{},
+	}
+	for _, entry := range entries {
+		if entry.prefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, listedPrefix{entry.name})
+			continue
+		}
+		result.Contents = append(result.Contents, innerXML{entry.innerXML})
+	}
+	if l.v2 {
+		keyCount := len(entries)
+		result.KeyCount = &keyCount
+		result.ContinuationToken = l.continuationToken
+		result.StartAfter = l.startAfter
+	} else {
+		marker := l.marker
+		result.Marker = &marker
+	}
+	if next == nil {
+		return result
+	}
+	if l.v2 {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next.key))
+	} else {
+		result.NextMarker = next.name
+	}
+	return result
+}
+
+// listObjects lists bucket in every cluster of region and merges listings
+func (sr ShardsRing) listObjects(req *http.Request, reqCopy *http.Request) (*http.Response, error) {
+	l, err := parseListing(reqCopy.URL.Query())
+	if err != nil {
+		return httphandler.S3ErrorResponse(req, httphandler.S3InvalidArgument.WithMessage(err.Error())), nil
+	}
+	listings, err := sr.listClusters(req, reqCopy, l)
+	if err != nil {
+		return nil, err
+	}
+	for _, cl := range listings {
+		if cl.err != nil || cl.resp.StatusCode != http.StatusOK {
+			closeListings(listings, cl)
+			return cl.resp, cl.err
+		}
+	}
+	defer closeListings(listings, nil)
+
+	entries, next := l.merge(listings)
+	body, err := xml.Marshal(l.result(listings[0].result.Name, entries, next))
+	if err != nil {
+		return nil, err
+	}
+	body = append([]byte(xml.Header), body...)
+	resp := *listings[0].resp
+	resp.Header = make(http.Header, len(listings[0].resp.Header))
+	for k, v := range listings[0].resp.Header {
+		resp.Header[k] = v
+	}
+	resp.Header.Set("Content-Type", "application/xml")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
+	resp.ContentLength = int64(len(body))
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.Request = req
+	return &resp, nil
+}
+
+// listClusters sends listing request to every cluster of region, listings
+// are sorted by cluster name
+func (sr ShardsRing) listClusters(req *http.Request, reqCopy *http.Request, l listing) ([]*clusterListing, error) {
+	clusters := make([]storages.Cluster, 0, len(sr.shardClusterMap))
+	for _, cluster := range sr.shardClusterMap {
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool { return clusters[i].Name < clusters[j].Name })
+
+	listings := make([]*clusterListing, len(clusters))
+	reqs := make([]*http.Request, len(clusters))
+	for i, cluster := range clusters {
+		clusterReq, err := l.clusterRequest(reqCopy)
+		if err != nil {
+			return nil, err
+		}
+		reqs[i] = clusterReq
+		listings[i] = &clusterListing{name: cluster.Name}
+	}
+	if sr.preProcessRequest != nil {
+		sr.preProcessRequest(req, reqs)
+	}
+	wg := sync.WaitGroup{}
+	for i, cluster := range clusters {
+		wg.Add(1)
+		go func(cluster storages.Cluster, clusterReq *http.Request, cl *clusterListing) {
+			defer wg.Done()
+			cl.resp, cl.err = sr.send(cluster, clusterReq)
+			if cl.err != nil || cl.resp.StatusCode != http.StatusOK {
+				return
+			}
+			cl.err = readListing(cl, l)
+		}(cluster, reqs[i], listings[i])
+	}
+	wg.Wait()
+	return listings, nil
+}
+
+func readListing(cl *clusterListing, l listing) error {
+	body, err := ioutil.ReadAll(io.LimitReader(cl.resp.Body, maxListingSize))
+	if closeErr := cl.resp.Body.Close(); err == nil {
+		err = closeErr
+	}
+	cl.resp.Body = http.NoBody
+	if err != nil {
+		return fmt.Errorf("cannot read listing of cluster %s: %s", cl.name, err)
+	}
+	if err := xml.Unmarshal(body, &cl.result); err != nil {
+		return fmt.Errorf("malformed listing of cluster %s: %s", cl.name, err)
+	}
+	cl.entries, cl.last = l.entries(cl.result)
+	cl.truncated = cl.result.IsTruncated
+	return nil
+}
+
+// closeListings closes responses of listings except given one
+func closeListings(listings []*clusterListing, except *clusterListing) {
+	for _, cl := range listings {
+		if cl == except || cl.resp == nil || cl.resp.Body == nil {
+			continue
+		}
+		_, _ = io.Copy(ioutil.Discard, cl.resp.Body)
+		if err := cl.resp.Body.Close(); err != nil {
+			log.Debugf("Cannot close listing response of cluster %s: %s", cl.name, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/allegro/akubra/storages"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (rtf roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rtf(req)
+}
+
+// fakeListing emulates ListObjects of backend storing given keys
+func fakeListing(keys ...string) http.RoundTripper {
+	sort.Strings(keys)
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+		after := query.Get("marker")
+		if query.Get("list-type") == "2" {
+			after = query.Get("start-after")
+		}
+		maxKeys := defaultMaxKeys
+		if query.Get("max-keys") != "" {
+			maxKeys, _ = strconv.Atoi(query.Get("max-keys"))
+		}
+		body := &bytes.Buffer{}
+		count, truncated := 0, false
+		lastPrefix := ""
+		for _, key := range keys {
+			if key <= after || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			entry := fmt.Sprintf("<Contents><Key>%s</Key><Size>1</Size></Contents>", key)
+			if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if commonPrefix == lastPrefix || commonPrefix <= after {
+					continue
+				}
+				lastPrefix = commonPrefix
+				entry = fmt.Sprintf("<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", commonPrefix)
+			}
+			if count == maxKeys {
+				truncated = true
+				break
+			}
+			body.WriteString(entry)
+			count++
+		}
+		content := fmt.Sprintf("<ListBucketResult><Name>bucket</Name><IsTruncated>%t</IsTruncated>%s</ListBucketResult>", truncated, body)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(content)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func makeListingRing(clusters ...http.RoundTripper) ShardsRing {
+	clusterMap := make(map[string]storages.Cluster, len(clusters))
+	for i, rt := range clusters {
+		name := fmt.Sprintf("cluster%d", i)
+		clusterMap[name] = storages.Cluster{RoundTripper: rt, Name: name}
+	}
+	return ShardsRing{shardClusterMap: clusterMap}
+}
+
+type listingPage struct {
+	IsTruncated           bool
+	NextMarker            string
+	NextContinuationToken string
+	KeyCount              int
+	Contents              []listedObject
+	CommonPrefixes        []listedPrefix
+}
+
+func listPage(t *testing.T, ring ShardsRing, query url.Values) listingPage {
+	reqURL := &url.URL{Scheme: "http", Host: "akubra", Path: "/bucket", RawQuery: query.Encode()}
+	resp, err := ring.DoRequest(&http.Request{Method: http.MethodGet, URL: reqURL, Header: make(http.Header)})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	page := listingPage{}
+	require.NoError(t, xml.Unmarshal(body, &page))
+	return page
+}
+
+// listAll pages through listing, returns listed keys and prefixes
+func listAll(t *testing.T, ring ShardsRing, query url.Values) []string {
+	listed := []string{}
+	for pages := 0; pages < 100; pages++ {
+		page := listPage(t, ring, query)
+		for _, object := range page.Contents {
+			listed = append(listed, object.Key)
+		}
+		for _, prefix := range page.CommonPrefixes {
+			listed = append(listed, prefix.Prefix)
+		}
+		if !page.IsTruncated {
+			return listed
+		}
+		if query.Get("list-type") == "2" {
+			require.NotEmpty(t, page.NextContinuationToken)
+			query.Set("continuation-token", page.NextContinuationToken)
+		} else {
+			require.NotEmpty(t, page.NextMarker)
+			query.Set("marker", page.NextMarker)
+		}
+	}
+	t.Fatal("Listing didn't finish")
+	return nil
+}
+
+func TestListingIsMergedAcrossClusters(t *testing.T) {
+	ring := makeListingRing(fakeListing("a", "c", "d", "f"), fakeListing("b", "e", "g"))
+
+	page := listPage(t, ring, url.Values{})
+
+	assert.False(t, page.IsTruncated)
+	keys := []string{}
+	for _, object := range page.Contents {
+		keys = append(keys, object.Key)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g"}, keys)
+}
+
+func TestListingV1PagesSpanClusters(t *testing.T) {
+	ring := makeListingRing(fakeListing("a", "c", "d", "f", "h"), fakeListing("b", "e", "g"))
+
+	listed := listAll(t, ring, url.Values{"max-keys": {"2"}})
+
+	assert.Equal(t, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, listed)
+}
+
+func TestListingV2ContinuationTokensSpanClusters(t *testing.T) {
+	ring := makeListingRing(fakeListing("a", "b", "c", "d"), fakeListing("e", "f"), fakeListing("ab", "cd"))
+
+	listed := listAll(t, ring, url.Values{"list-type": {"2"}, "max-keys": {"3"}})
+
+	assert.Equal(t, []string{"a", "ab", "b", "c", "cd", "d", "e", "f"}, listed)
+}
+
+func TestListingMergesCommonPrefixes(t *testing.T) {
+	ring := makeListingRing(fakeListing("dir/a", "dir/b", "x"), fakeListing("dir/c", "other/a", "y"))
+
+	listed := listAll(t, ring, url.Values{"delimiter": {"/"}, "max-keys": {"1"}})
+
+	assert.Equal(t, []string{"dir/", "other/", "x", "y"}, listed)
+}
+
+func TestListingKeysStoredInManyClustersAreListedOnce(t *testing.T) {
+	ring := makeListingRing(fakeListing("a", "b"), fakeListing("b", "c"))
+
+	listed := listAll(t, ring, url.Values{"list-type": {"2"}})
+
+	assert.Equal(t, []string{"a", "b", "c"}, listed)
+}
+
+func TestListingFailsIfAnyClusterFails(t *testing.T) {
+	failing := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+	})
+	ring := makeListingRing(fakeListing("a"), failing)
+	reqURL, _ := url.Parse("http://akubra/bucket")
+
+	resp, err := ring.DoRequest(&http.Request{Method: http.MethodGet, URL: reqURL, Header: make(http.Header)})
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestInvalidContinuationTokenIsRejected(t *testing.T) {
+	ring := makeListingRing(fakeListing("a"), fakeListing("b"))
+	reqURL, _ := url.Parse("http://akubra/bucket?list-type=2&continuation-token=%25%25")
+
+	resp, err := ring.DoRequest(&http.Request{Method: http.MethodGet, URL: reqURL, Header: make(http.Header)})
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestListingContinuesAfterPageWithoutEntriesAboveMarker(t *testing.T) {
+	// like S3, cluster rolls keys after marker placed inside common prefix
+	// up into that prefix
+	rest := fakeListing("dir/b", "z")
+	rollup := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		query := req.URL.Query()
+		after := query.Get("marker") + query.Get("start-after")
+		if after == "dir/" || !strings.HasPrefix(after, "dir/") {
+			return rest.RoundTrip(req)
+		}
+		content := "<ListBucketResult><Name>bucket</Name><IsTruncated>true</IsTruncated>" +
+			"<CommonPrefixes><Prefix>dir/</Prefix></CommonPrefixes></ListBucketResult>"
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(content)),
+			Request:    req,
+		}, nil
+	})
+	ring := makeListingRing(rollup, fakeListing("y"))
+
+	for _, query := range []url.Values{
+		{"delimiter": {"/"}, "marker": {"dir/a"}},
+		{"delimiter": {"/"}, "list-type": {"2"}, "start-after": {"dir/a"}},
+	} {
+		listed := listAll(t, ring, query)
+
+		assert.Equal(t, []string{"y", "z"}, listed, "%v", query)
+	}
+}
+
+func TestListingWithZeroMaxKeysIsNotTruncated(t *testing.T) {
+	ring := makeListingRing(fakeListing("a", "b"), fakeListing("c"))
+
+	for _, query := range []url.Values{
+		{"max-keys": {"0"}},
+		{"max-keys": {"0"}, "list-type": {"2"}},
+	} {
+		page := listPage(t, ring, query)
+
+		assert.False(t, page.IsTruncated, "%v", query)
+		assert.Empty(t, page.Contents, "%v", query)
+	}
+}
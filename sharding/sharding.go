@@ -89,22 +89,38 @@ func (rf RingFactory) RegionRing(regionCfg shardingconfig.RegionConfig) (ShardsR
 	}
 
 	respHandler := httphandler.LateResponseHandler(rf.conf)
+	if regionCfg.WriteQuorum > 0 {
+		respHandler = httphandler.QuorumResponseHandler(rf.conf, regionCfg.WriteQuorum)
+	}
 
 	regressionMap, err := rf.createRegressionMap(regionCfg)
 	if err != nil {
 		return ShardsRing{}, nil
 	}
-	allBackendsRoundTripper := transport.NewMultiTransport(
-		rf.transport,
+	regionTransport, err := rf.storages.RegionRoundTripper(regionCfg, rf.transport)
+	if err != nil {
+		return ShardsRing{}, err
+	}
+	regionProcessor, err := transport.NewRequestProcessor(regionCfg.RequestProcessors)
+	if err != nil {
+		return ShardsRing{}, err
+	}
+	backendsProcessor, err := rf.storages.RegionRequestProcessor(regionCfg)
+	if err != nil {
+		return ShardsRing{}, err
+	}
+	allBackendsRoundTripper := rf.storages.NewMultiTransport(
+		regionTransport,
 		allBackendsSlice,
-		respHandler,
-		rf.conf.MaintainedBackends)
+		respHandler)
+	allBackendsRoundTripper.PreProcessRequest = backendsProcessor
 	return ShardsRing{
 		cHashMap,
 		shardClusterMap,
 		allBackendsRoundTripper,
 		regressionMap,
-		rf.conf.ClusterSyncLog}, nil
+		rf.conf.ClusterSyncLog,
+		regionProcessor}, nil
 }
 
 //NewRingFactory creates ring factory
@@ -14,6 +14,7 @@ import (
 	"github.com/allegro/akubra/log"
 	"github.com/allegro/akubra/metrics"
 	"github.com/allegro/akubra/storages"
+	"github.com/allegro/akubra/transport"
 	"github.com/serialx/hashring"
 )
 
@@ -30,6 +31,9 @@ type ShardsRing struct {
 	allClustersRoundTripper http.RoundTripper
 	clusterRegressionMap    map[string]storages.Cluster
 	inconsistencyLog        log.Logger
+	// preProcessRequest runs region request processors on requests sent
+	// to clusters, nil if region has no processors
+	preProcessRequest transport.RequestProcessor
 }
 
 func (sr ShardsRing) isBucketPath(path string) bool {
@@ -81,7 +85,9 @@ func copyRequest(origReq *http.Request) (*http.Request, error) {
 			newReq.Header.Add(k, vv)
 		}
 	}
-	if origReq.Body != nil {
+	// PUT is never repeated on regression cluster, so there is no need
+	// to keep its body in memory
+	if origReq.Body != nil && origReq.Method != http.MethodPut {
 		buf := new(bytes.Buffer)
 		_, err := io.Copy(buf, origReq.Body)
 		if err != nil {
@@ -162,18 +168,26 @@ func (sr ShardsRing) DoRequest(req *http.Request) (resp *http.Response, rerr err
 		return nil, err
 	}
 
+	if len(sr.shardClusterMap) > 1 && sr.isBucketPath(reqCopy.URL.Path) && isListObjectsRequest(reqCopy) {
+		return sr.listObjects(req, reqCopy)
+	}
+
 	if reqCopy.Method == http.MethodDelete || sr.isBucketPath(reqCopy.URL.Path) {
 		return sr.allClustersRoundTripper.RoundTrip(reqCopy)
 	}
 
-	cl, err := sr.Pick(reqCopy.URL.Path)
+	key := reqCopy.URL.Path
+	cl, err := sr.Pick(key)
 	if err != nil {
 		return nil, err
 	}
+	if sr.preProcessRequest != nil {
+		sr.preProcessRequest(req, []*http.Request{reqCopy})
+	}
 
 	clusterName, resp, err := sr.regressionCall(cl, reqCopy)
 	if clusterName != cl.Name {
-		sr.logInconsistency(reqCopy.URL.Path, cl.Name, clusterName)
+		sr.logInconsistency(key, cl.Name, clusterName)
 	}
 
 	return resp, err
@@ -0,0 +1,295 @@
+package signature
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	amzDecodedLengthHeader = "X-Amz-Decoded-Content-Length"
+	amzTrailerHeader       = "X-Amz-Trailer"
+	awsChunkedEncoding     = "aws-chunked"
+	// signedStreamingPayload is payload hash of uploads with chunk
+	// signatures chained from request signature
+	signedStreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	// unsignedStreamingPayload is payload hash of aws-chunked uploads
+	// without chunk signatures
+	unsignedStreamingPayload = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	chunkSignatureAlgorithm  = "AWS4-HMAC-SHA256-PAYLOAD"
+	chunkSignaturePrefix     = "chunk-signature="
+	// maxSignedChunkSize limits chunk buffered until its signature is
+	// verified
+	maxSignedChunkSize = 8 << 20
+)
+
+var (
+	// ErrMalformedChunk is returned by body of request with invalid
+	// aws-chunked payload
+	ErrMalformedChunk = errors.New("Malformed aws-chunked payload")
+	// ErrUnsupportedPayload is returned for chunk signed payloads which
+	// can't be verified
+	ErrUnsupportedPayload = errors.New("Unsupported chunk signed payload")
+)
+
+// emptySHA256 is hex encoded hash of empty string
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// decodeChunkedPayload replaces aws-chunked body of streaming V4 request,
+// which chunk signatures are made with client seed signature and can't be
+// re-signed, with decoded payload sent as UNSIGNED-PAYLOAD
+func decodeChunkedPayload(req *http.Request) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = newChunkedPayloadReader(req.Body)
+	}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return newChunkedPayloadReader(body), nil
+		}
+	}
+	req.ContentLength = -1
+	if decoded, err := strconv.ParseInt(req.Header.Get(amzDecodedLengthHeader), 10, 64); err == nil && decoded >= 0 {
+		req.ContentLength = decoded
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Del(amzDecodedLengthHeader)
+	req.Header.Del(amzTrailerHeader)
+	req.Header.Set(amzContentSHAHeader, unsignedPayload)
+	encodings := []string{}
+	for _, encoding := range strings.Split(req.Header.Get("Content-Encoding"), ",") {
+		encoding = strings.TrimSpace(encoding)
+		if encoding != "" && encoding != awsChunkedEncoding {
+			encodings = append(encodings, encoding)
+		}
+	}
+	if len(encodings) == 0 {
+		req.Header.Del("Content-Encoding")
+		return
+	}
+	req.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+}
+
+// chunkedPayloadReader decodes aws-chunked payload, chunk signatures and
+// trailing headers are dropped
+type chunkedPayloadReader struct {
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	started   bool
+	remaining int64
+	err       error
+}
+
+func newChunkedPayloadReader(body io.ReadCloser) *chunkedPayloadReader {
+	return &chunkedPayloadReader{body: body, reader: bufio.NewReader(body)}
+}
+
+func (cpr *chunkedPayloadReader) Read(p []byte) (int, error) {
+	if cpr.err != nil {
+		return 0, cpr.err
+	}
+	if cpr.remaining == 0 {
+		if cpr.err = cpr.nextChunk(); cpr.err != nil {
+			return 0, cpr.err
+		}
+	}
+	if int64(len(p)) > cpr.remaining {
+		p = p[:cpr.remaining]
+	}
+	n, err := cpr.reader.Read(p)
+	cpr.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cpr.err = err
+	return n, err
+}
+
+// nextChunk reads chunk header, io.EOF is returned after last chunk
+func (cpr *chunkedPayloadReader) nextChunk() error {
+	if cpr.started {
+		// data of previous chunk is followed by CRLF
+		if line, err := readChunkLine(cpr.reader); err != nil || line != "" {
+			return malformedChunk(err)
+		}
+	}
+	cpr.started = true
+	line, err := readChunkLine(cpr.reader)
+	if err != nil {
+		return malformedChunk(err)
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+	if err != nil || size < 0 {
+		return ErrMalformedChunk
+	}
+	if size > 0 {
+		cpr.remaining = size
+		return nil
+	}
+	// last chunk may be followed by trailing headers and empty line
+	for {
+		line, err := readChunkLine(cpr.reader)
+		if err == io.EOF || err == nil && line == "" {
+			return io.EOF
+		}
+		if err != nil {
+			return malformedChunk(err)
+		}
+	}
+}
+
+// readChunkLine reads line of chunk header, line ending is trimmed
+func readChunkLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", ErrMalformedChunk
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func malformedChunk(err error) error {
+	if err == nil || err == io.EOF {
+		return ErrMalformedChunk
+	}
+	return err
+}
+
+func (cpr *chunkedPayloadReader) Close() error {
+	return cpr.body.Close()
+}
+
+// chunkSignatureChain signs chunks of streaming upload, first chunk
+// signature is chained from seed signature of request
+type chunkSignatureChain struct {
+	key       []byte
+	timestamp string
+	scope     string
+	seed      string
+}
+
+// verifyChunkSignatures wraps body of streaming V4 request with reader
+// verifying chunk signatures. Chunk is passed on unchanged only after its
+// signature is verified, so payload is never forwarded whole unless all
+// signatures are valid.
+func verifyChunkSignatures(req *http.Request, payloadHash string, chain chunkSignatureChain) error {
+	switch payloadHash {
+	case unsignedStreamingPayload:
+		return nil
+	case signedStreamingPayload:
+	default:
+		return ErrUnsupportedPayload
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = newSignedChunkReader(req.Body, chain)
+	}
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return newSignedChunkReader(body, chain), nil
+		}
+	}
+	return nil
+}
+
+// signedChunkReader returns aws-chunked payload chunk by chunk, each one
+// after its signature is verified
+type signedChunkReader struct {
+	body     io.ReadCloser
+	reader   *bufio.Reader
+	chain    chunkSignatureChain
+	previous string
+	pending  []byte
+	// last is set once final chunk is verified, rest of payload is passed
+	// as it is
+	last bool
+	err  error
+}
+
+func newSignedChunkReader(body io.ReadCloser, chain chunkSignatureChain) *signedChunkReader {
+	return &signedChunkReader{body: body, reader: bufio.NewReader(body), chain: chain, previous: chain.seed}
+}
+
+func (scr *signedChunkReader) Read(p []byte) (int, error) {
+	for len(scr.pending) == 0 {
+		if scr.last {
+			return scr.reader.Read(p)
+		}
+		if scr.err != nil {
+			return 0, scr.err
+		}
+		scr.err = scr.nextChunk()
+	}
+	n := copy(p, scr.pending)
+	scr.pending = scr.pending[n:]
+	return n, nil
+}
+
+// nextChunk reads and verifies next chunk
+func (scr *signedChunkReader) nextChunk() error {
+	line, err := readChunkLine(scr.reader)
+	if err != nil {
+		return malformedChunk(err)
+	}
+	i := strings.IndexByte(line, ';')
+	if i < 0 || !strings.HasPrefix(line[i+1:], chunkSignaturePrefix) {
+		return ErrMalformedChunk
+	}
+	size, err := strconv.ParseInt(line[:i], 16, 64)
+	if err != nil || size < 0 || size > maxSignedChunkSize {
+		return ErrMalformedChunk
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(scr.reader, data); err != nil {
+		return malformedChunk(err)
+	}
+	chunk := append([]byte(line+"\r\n"), data...)
+	if size > 0 {
+		if crlf, err := readChunkLine(scr.reader); err != nil || crlf != "" {
+			return malformedChunk(err)
+		}
+		chunk = append(chunk, "\r\n"...)
+	}
+	dataHash := sha256.Sum256(data)
+	stringToSign := strings.Join([]string{
+		chunkSignatureAlgorithm,
+		scr.chain.timestamp,
+		scr.chain.scope,
+		scr.previous,
+		emptySHA256,
+		hex.EncodeToString(dataHash[:]),
+	}, "\n")
+	expected := hex.EncodeToString(hmacSHA256(scr.chain.key, stringToSign))
+	signature := line[i+1+len(chunkSignaturePrefix):]
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrSignatureMismatch
+	}
+	scr.previous = signature
+	scr.pending = chunk
+	scr.last = size == 0
+	return nil
+}
+
+func (scr *signedChunkReader) Close() error {
+	return scr.body.Close()
+}
@@ -0,0 +1,110 @@
+package signature
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	authorizationHeader  = "Authorization"
+	amzDateHeader        = "X-Amz-Date"
+	amzContentSHAHeader  = "X-Amz-Content-Sha256"
+	amzSecurityToken     = "X-Amz-Security-Token"
+	unsignedPayload      = "UNSIGNED-PAYLOAD"
+	streamingPayload     = "STREAMING-"
+	defaultSigningRegion = "us-east-1"
+)
+
+// presignedV4Params are query parameters of presigned V4 requests
+var presignedV4Params = []string{
+	"X-Amz-Algorithm",
+	"X-Amz-Credential",
+	"X-Amz-Date",
+	"X-Amz-Expires",
+	"X-Amz-SignedHeaders",
+	"X-Amz-Signature",
+	"X-Amz-Security-Token",
+}
+
+// Credentials are backend access keys
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+	// Region in V4 signature scope, default us-east-1
+	Region string
+}
+
+// Signer replaces client signature of backend requests with signature made
+// with backend credentials
+type Signer struct {
+	credentials Credentials
+	now         func() time.Time
+}
+
+// NewSigner creates Signer for backend credentials
+func NewSigner(credentials Credentials) *Signer {
+	if credentials.Region == "" {
+		credentials.Region = defaultSigningRegion
+	}
+	return &Signer{credentials: credentials, now: time.Now}
+}
+
+// Process re-signs copies of signed client request with signature version
+// used by client, copies of anonymous requests are left anonymous. Client
+// signature is stripped, it's not valid for backend. Chunk signed payloads
+// are decoded and sent unsigned. Signature matches
+// transport.RequestProcessor, so it should run as the last processor.
+func (s *Signer) Process(orig *http.Request, copies []*http.Request) {
+	if !isSigned(orig) {
+		return
+	}
+	v2 := isSignedV2(orig)
+	for _, r := range copies {
+		stripSignature(r)
+		if v2 {
+			s.signV2(r)
+			continue
+		}
+		if strings.HasPrefix(r.Header.Get(amzContentSHAHeader), streamingPayload) {
+			decodeChunkedPayload(r)
+		}
+		s.signV4(r)
+	}
+}
+
+// isSigned reports if request has header or query signature
+func isSigned(req *http.Request) bool {
+	if req.Header.Get(authorizationHeader) != "" {
+		return true
+	}
+	return req.URL.Query().Get("X-Amz-Signature") != "" || isSignedV2(req)
+}
+
+// stripSignature removes client V2 or V4 signature from request
+func stripSignature(req *http.Request) {
+	req.Header.Del(authorizationHeader)
+	req.Header.Del(amzDateHeader)
+	req.Header.Del(amzSecurityToken)
+	query := req.URL.Query()
+	stripped := false
+	for _, params := range [][]string{presignedV4Params, presignedV2Params} {
+		for _, name := range params {
+			if _, ok := query[name]; ok {
+				query.Del(name)
+				stripped = true
+			}
+		}
+	}
+	if stripped {
+		req.URL.RawQuery = query.Encode()
+	}
+}
+
+// requestHost returns host sent to backend
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
@@ -0,0 +1,145 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	v2AuthorizationPrefix = "AWS "
+	v2DateFormat          = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+// presignedV2Params are query parameters of presigned V2 requests
+var presignedV2Params = []string{"AWSAccessKeyId", "Signature", "Expires"}
+
+// v2SubResources are query parameters included in V2 canonicalized resource
+var v2SubResources = map[string]bool{
+	"acl":                          true,
+	"cors":                         true,
+	"delete":                       true,
+	"lifecycle":                    true,
+	"location":                     true,
+	"logging":                      true,
+	"notification":                 true,
+	"partNumber":                   true,
+	"policy":                       true,
+	"replication":                  true,
+	"requestPayment":               true,
+	"response-cache-control":       true,
+	"response-content-disposition": true,
+	"response-content-encoding":    true,
+	"response-content-language":    true,
+	"response-content-type":        true,
+	"response-expires":             true,
+	"restore":                      true,
+	"tagging":                      true,
+	"torrent":                      true,
+	"uploadId":                     true,
+	"uploads":                      true,
+	"versionId":                    true,
+	"versioning":                   true,
+	"versions":                     true,
+	"website":                      true,
+}
+
+// isSignedV2 reports if request has V2 header or query signature
+func isSignedV2(req *http.Request) bool {
+	if strings.HasPrefix(req.Header.Get(authorizationHeader), v2AuthorizationPrefix) {
+		return true
+	}
+	query := req.URL.Query()
+	return query.Get("Signature") != "" && query.Get("AWSAccessKeyId") != ""
+}
+
+// signV2 signs request with header based AWS Signature Version 2
+func (s *Signer) signV2(req *http.Request) {
+	req.Header.Set("Date", s.now().UTC().Format(v2DateFormat))
+	req.Header.Set(authorizationHeader, s.authorizationV2(req))
+}
+
+func (s *Signer) authorizationV2(req *http.Request) string {
+	stringToSign := stringToSignV2(req, dateV2(req), canonicalResourceV2(req))
+	return v2AuthorizationPrefix + s.credentials.AccessKey + ":" + signatureV2(s.credentials.SecretKey, stringToSign)
+}
+
+// signatureV2 returns base64 encoded HMAC-SHA1 of string to sign
+func signatureV2(secretKey, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	_, _ = mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// dateV2 returns date of string to sign, it's empty if X-Amz-Date header
+// is set, as it's signed with other x-amz-* headers
+func dateV2(req *http.Request) string {
+	if req.Header.Get(amzDateHeader) != "" {
+		return ""
+	}
+	return req.Header.Get("Date")
+}
+
+// stringToSignV2 returns V2 string to sign, date is Expires of presigned
+// requests
+func stringToSignV2(req *http.Request, date, resource string) string {
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		date,
+	}, "\n") + "\n" + canonicalAmzHeadersV2(req) + resource
+}
+
+func canonicalAmzHeadersV2(req *http.Request) string {
+	names := []string{}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		values := req.Header[http.CanonicalHeaderKey(name)]
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.TrimSpace(value))
+		}
+		canonical.WriteString(name + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+	return canonical.String()
+}
+
+// canonicalResourceV2 returns bucket, path and sub-resources, bucket of
+// virtual-hosted request is taken from host
+func canonicalResourceV2(req *http.Request) string {
+	resource := req.URL.EscapedPath()
+	if resource == "" {
+		resource = "/"
+	}
+	// virtual-hosted request, bucket is part of resource
+	if host := requestHost(req); host != req.URL.Host && strings.HasSuffix(host, "."+req.URL.Host) {
+		resource = "/" + strings.TrimSuffix(host, "."+req.URL.Host) + resource
+	}
+	query := req.URL.Query()
+	subResources := []string{}
+	for name, values := range query {
+		if !v2SubResources[name] {
+			continue
+		}
+		if len(values) == 0 || values[0] == "" {
+			subResources = append(subResources, name)
+			continue
+		}
+		subResources = append(subResources, name+"="+values[0])
+	}
+	if len(subResources) == 0 {
+		return resource
+	}
+	sort.Strings(subResources)
+	return resource + "?" + strings.Join(subResources, "&")
+}
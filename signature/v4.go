@@ -0,0 +1,153 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	v4Algorithm     = "AWS4-HMAC-SHA256"
+	v4TimeFormat    = "20060102T150405Z"
+	v4DateFormat    = "20060102"
+	v4Service       = "s3"
+	v4ScopeTerminal = "aws4_request"
+)
+
+// signV4 signs request with header based AWS Signature Version 4. Payload
+// hash sent by client is kept, UNSIGNED-PAYLOAD is used if there is none.
+func (s *Signer) signV4(req *http.Request) {
+	now := s.now().UTC()
+	req.Header.Set(amzDateHeader, now.Format(v4TimeFormat))
+	if req.Header.Get(amzContentSHAHeader) == "" {
+		req.Header.Set(amzContentSHAHeader, unsignedPayload)
+	}
+	req.Header.Set(authorizationHeader, s.authorizationV4(req, v4SignedHeaders(req), now))
+}
+
+// v4SignedHeaders returns names of signed headers: host, content-md5,
+// content-type and all x-amz-* headers present in request
+func v4SignedHeaders(req *http.Request) []string {
+	names := []string{"host"}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-md5" || lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Signer) authorizationV4(req *http.Request, signedHeaders []string, now time.Time) string {
+	scope := v4Scope(now, s.credentials.Region)
+	signature := signatureV4(req, s.credentials.SecretKey, s.credentials.Region, now,
+		signedHeaders, canonicalQueryV4(req.URL.Query()), req.Header.Get(amzContentSHAHeader))
+	return fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		v4Algorithm, s.credentials.AccessKey, scope, strings.Join(signedHeaders, ";"), signature)
+}
+
+func v4Scope(t time.Time, region string) string {
+	return strings.Join([]string{t.Format(v4DateFormat), region, v4Service, v4ScopeTerminal}, "/")
+}
+
+// signatureV4 returns hex encoded signature of request made at t
+func signatureV4(req *http.Request, secretKey, region string, t time.Time, signedHeaders []string, canonicalQuery, payloadHash string) string {
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURIV4(req),
+		canonicalQuery,
+		canonicalHeadersV4(req, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		v4Algorithm,
+		t.Format(v4TimeFormat),
+		v4Scope(t, region),
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(signingKeyV4(secretKey, region, t), stringToSign))
+}
+
+// signingKeyV4 derives key signing requests made at t in region
+func signingKeyV4(secretKey, region string, t time.Time) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), t.Format(v4DateFormat))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, v4Service)
+	return hmacSHA256(key, v4ScopeTerminal)
+}
+
+func canonicalURIV4(req *http.Request) string {
+	if req.URL.Path == "" {
+		return "/"
+	}
+	return uriEncode(req.URL.Path, false)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQueryV4 returns encoded query parameters sorted by encoded name,
+// values of same name are sorted by encoded value
+func canonicalQueryV4(query url.Values) string {
+	params := [][2]string{}
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, [2]string{uriEncode(name, true), uriEncode(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, 0, len(params))
+	for _, param := range params {
+		pairs = append(pairs, param[0]+"="+param[1])
+	}
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeadersV4(req *http.Request, signedHeaders []string) string {
+	var canonical strings.Builder
+	for _, name := range signedHeaders {
+		values := req.Header[http.CanonicalHeaderKey(name)]
+		if name == "host" {
+			values = []string{requestHost(req)}
+		}
+		trimmed := make([]string, 0, len(values))
+		for _, value := range values {
+			trimmed = append(trimmed, strings.Join(strings.Fields(value), " "))
+		}
+		canonical.WriteString(name + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+	return canonical.String()
+}
+
+// uriEncode encodes all characters but unreserved ones, slash is kept
+// unless encodeSlash is set
+func uriEncode(value string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			encoded.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&encoded, "%%%02X", c)
+	}
+	return encoded.String()
+}
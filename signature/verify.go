@@ -0,0 +1,251 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/allegro/akubra/transport"
+)
+
+const (
+	// maxClockSkew is allowed difference between request date and now
+	maxClockSkew = 15 * time.Minute
+	// maxPresignedV4Expires is longest validity of presigned V4 request
+	maxPresignedV4Expires = 7 * 24 * 60 * 60
+)
+
+var (
+	// ErrNotSigned is returned for anonymous requests
+	ErrNotSigned = errors.New("Request is not signed")
+	// ErrMalformedSignature is returned if signature can't be parsed
+	ErrMalformedSignature = errors.New("Malformed request signature")
+	// ErrUnknownAccessKey is returned if access key is not known
+	ErrUnknownAccessKey = errors.New("Unknown access key")
+	// ErrSignatureMismatch is returned if signature is invalid
+	ErrSignatureMismatch = errors.New("Request signature does not match")
+	// ErrSignatureExpired is returned for expired presigned requests and
+	// requests signed too long ago
+	ErrSignatureExpired = errors.New("Request signature expired")
+)
+
+// SecretKeys returns secret key of access key
+type SecretKeys func(accessKey string) (secretKey string, ok bool)
+
+// Verifier checks AWS Signature Version 2 and 4 of client requests
+type Verifier struct {
+	secretKeys SecretKeys
+	// domains are needed to find bucket of virtual-hosted V2 requests
+	domains []string
+	now     func() time.Time
+}
+
+// NewVerifier creates Verifier of requests sent to domains
+func NewVerifier(secretKeys SecretKeys, domains []string) *Verifier {
+	return &Verifier{secretKeys: secretKeys, domains: domains, now: time.Now}
+}
+
+// Verify checks header or query signature of client request, it returns
+// access key which signed request. Payload hash of V4 requests is signed
+// but not compared with body. Chunk signatures of streaming uploads are
+// verified while body is read, body read fails on invalid signature.
+func (v *Verifier) Verify(req *http.Request) (string, error) {
+	query := req.URL.Query()
+	authorization := req.Header.Get(authorizationHeader)
+	switch {
+	case strings.HasPrefix(authorization, v4Algorithm+" "):
+		return v.verifyV4(req, strings.TrimPrefix(authorization, v4Algorithm+" "))
+	case strings.HasPrefix(authorization, v2AuthorizationPrefix):
+		return v.verifyV2(req, strings.TrimPrefix(authorization, v2AuthorizationPrefix))
+	case authorization != "":
+		return "", ErrMalformedSignature
+	case query.Get("X-Amz-Signature") != "":
+		return v.verifyPresignedV4(req, query)
+	case isSignedV2(req):
+		return v.verifyPresignedV2(req, query)
+	}
+	return "", ErrNotSigned
+}
+
+// v4Credential is parsed credential of V4 signature
+type v4Credential struct {
+	accessKey string
+	date      string
+	region    string
+}
+
+func parseV4Credential(credential string) (v4Credential, error) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != v4Service || parts[4] != v4ScopeTerminal {
+		return v4Credential{}, ErrMalformedSignature
+	}
+	return v4Credential{accessKey: parts[0], date: parts[1], region: parts[2]}, nil
+}
+
+func (v *Verifier) verifyV4(req *http.Request, authorization string) (string, error) {
+	fields := make(map[string]string)
+	for _, field := range strings.Split(authorization, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return "", ErrMalformedSignature
+		}
+		fields[kv[0]] = kv[1]
+	}
+	credential, err := parseV4Credential(fields["Credential"])
+	if err != nil {
+		return "", err
+	}
+	date := req.Header.Get(amzDateHeader)
+	signedAt, err := time.Parse(v4TimeFormat, date)
+	if date == "" {
+		signedAt, err = parseHTTPDate(req.Header.Get("Date"))
+	}
+	if err != nil {
+		return "", ErrMalformedSignature
+	}
+	if skew := v.now().Sub(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return "", ErrSignatureExpired
+	}
+	return v.compareV4(req, credential, signedAt, fields["SignedHeaders"], canonicalQueryV4(req.URL.Query()),
+		req.Header.Get(amzContentSHAHeader), fields["Signature"])
+}
+
+func (v *Verifier) verifyPresignedV4(req *http.Request, query url.Values) (string, error) {
+	if query.Get("X-Amz-Algorithm") != v4Algorithm {
+		return "", ErrMalformedSignature
+	}
+	credential, err := parseV4Credential(query.Get("X-Amz-Credential"))
+	if err != nil {
+		return "", err
+	}
+	signedAt, err := time.Parse(v4TimeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return "", ErrMalformedSignature
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || expires > maxPresignedV4Expires {
+		return "", ErrMalformedSignature
+	}
+	now := v.now()
+	if now.After(signedAt.Add(time.Duration(expires)*time.Second)) || signedAt.Sub(now) > maxClockSkew {
+		return "", ErrSignatureExpired
+	}
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+	payloadHash := unsignedPayload
+	if hash := req.Header.Get(amzContentSHAHeader); hash != "" {
+		payloadHash = hash
+	}
+	return v.compareV4(req, credential, signedAt, query.Get("X-Amz-SignedHeaders"), canonicalQueryV4(query),
+		payloadHash, signature)
+}
+
+func (v *Verifier) compareV4(req *http.Request, credential v4Credential, signedAt time.Time, signedHeaders, canonicalQuery, payloadHash, signature string) (string, error) {
+	signedAt = signedAt.UTC()
+	if credential.date != signedAt.Format(v4DateFormat) || signedHeaders == "" || signature == "" {
+		return "", ErrMalformedSignature
+	}
+	headers := strings.Split(signedHeaders, ";")
+	if !containsString(headers, "host") {
+		return "", ErrMalformedSignature
+	}
+	secretKey, ok := v.secretKeys(credential.accessKey)
+	if !ok {
+		return "", ErrUnknownAccessKey
+	}
+	expected := signatureV4(req, secretKey, credential.region, signedAt, headers, canonicalQuery, payloadHash)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", ErrSignatureMismatch
+	}
+	if strings.HasPrefix(payloadHash, streamingPayload) {
+		chain := chunkSignatureChain{
+			key:       signingKeyV4(secretKey, credential.region, signedAt),
+			timestamp: signedAt.Format(v4TimeFormat),
+			scope:     v4Scope(signedAt, credential.region),
+			seed:      signature,
+		}
+		if err := verifyChunkSignatures(req, payloadHash, chain); err != nil {
+			return "", err
+		}
+	}
+	return credential.accessKey, nil
+}
+
+func (v *Verifier) verifyV2(req *http.Request, authorization string) (string, error) {
+	i := strings.LastIndex(authorization, ":")
+	if i <= 0 {
+		return "", ErrMalformedSignature
+	}
+	date := req.Header.Get(amzDateHeader)
+	if date == "" {
+		date = req.Header.Get("Date")
+	}
+	signedAt, err := parseHTTPDate(date)
+	if err != nil {
+		return "", ErrMalformedSignature
+	}
+	if skew := v.now().Sub(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return "", ErrSignatureExpired
+	}
+	return v.compareV2(req, authorization[:i], dateV2(req), authorization[i+1:])
+}
+
+func (v *Verifier) verifyPresignedV2(req *http.Request, query url.Values) (string, error) {
+	expires, err := strconv.ParseInt(query.Get("Expires"), 10, 64)
+	if err != nil {
+		return "", ErrMalformedSignature
+	}
+	if v.now().Unix() > expires {
+		return "", ErrSignatureExpired
+	}
+	return v.compareV2(req, query.Get("AWSAccessKeyId"), query.Get("Expires"), query.Get("Signature"))
+}
+
+func (v *Verifier) compareV2(req *http.Request, accessKey, date, signature string) (string, error) {
+	secretKey, ok := v.secretKeys(accessKey)
+	if !ok {
+		return "", ErrUnknownAccessKey
+	}
+	expected := signatureV2(secretKey, stringToSignV2(req, date, v.canonicalResourceV2(req)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", ErrSignatureMismatch
+	}
+	return accessKey, nil
+}
+
+// canonicalResourceV2 returns canonical resource of client request, bucket
+// of virtual-hosted request is taken from host
+func (v *Verifier) canonicalResourceV2(req *http.Request) string {
+	address := transport.ParseS3Address(req.Host, req.URL.Path, v.domains)
+	pathStyle := *req
+	pathStyle.Host = ""
+	pathStyle.URL = &url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	if address.VirtualHosted {
+		pathStyle.URL.Path = "/" + address.Bucket + req.URL.Path
+		pathStyle.URL.RawPath = "/" + address.Bucket + req.URL.EscapedPath()
+	}
+	return canonicalResourceV2(&pathStyle)
+}
+
+// parseHTTPDate parses date in formats allowed by HTTP and numeric time
+// zone used by many S3 clients
+func parseHTTPDate(date string) (time.Time, error) {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return time.Parse(time.RFC1123Z, date)
+	}
+	return t, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package storages
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -8,6 +9,7 @@ import (
 	"github.com/allegro/akubra/config"
 	"github.com/allegro/akubra/httphandler"
 	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/allegro/akubra/signature"
 	"github.com/allegro/akubra/transport"
 )
 
@@ -23,28 +25,111 @@ type Storages struct {
 	Conf      config.Config
 	Transport http.RoundTripper
 	Clusters  map[string]Cluster
+	// Breakers are shared by all clusters, nil if disabled
+	Breakers *transport.CircuitBreakers
+	// Health checks backends of all clusters, nil if disabled
+	Health *transport.HealthChecker
+	// Spill is shared by all clusters, nil if disabled
+	Spill *transport.BodySpill
+	// Bulkheads are shared by all clusters, nil if disabled
+	Bulkheads *transport.Bulkheads
+	// Replication queues writes of async clusters, nil if disabled
+	Replication *transport.ReplicationQueue
+	// Multipart is shared by all clusters and regions, nil if disabled
+	Multipart *transport.MultipartUploads
 }
 
-func newMultiBackendCluster(transp http.RoundTripper,
+// NewMultiTransport creates transport.MultiTransport with settings shared by
+// all clusters
+func (st Storages) NewMultiTransport(transp http.RoundTripper,
+	backends []url.URL,
+	multiResponseHandler transport.MultipleResponsesHandler) *transport.MultiTransport {
+	multiTransport := transport.NewMultiTransport(
+		transp,
+		backends,
+		multiResponseHandler,
+		st.Conf.MaintainedBackends)
+
+	multiTransport.Breakers = st.Breakers
+	multiTransport.Health = st.Health
+	multiTransport.Spill = st.Spill
+	multiTransport.Bulkheads = st.Bulkheads
+	multiTransport.Multipart = st.Multipart
+
+	streamingConf := st.Conf.BodyStreaming
+	if streamingConf.Enabled {
+		multiTransport.Streaming = &transport.BodyStreaming{
+			ChunkSize:          int(streamingConf.ChunkSize.SizeInBytes),
+			QueueLength:        streamingConf.QueueLength,
+			SlowBackendTimeout: streamingConf.SlowBackendTimeout.Duration,
+		}
+	}
+
+	retriesConf := st.Conf.BackendRetries
+	if retriesConf.Enabled {
+		multiTransport.Retries = &transport.RetryPolicy{
+			MaxAttempts:    retriesConf.MaxAttempts,
+			InitialBackoff: retriesConf.InitialBackoff.Duration,
+			MaxBackoff:     retriesConf.MaxBackoff.Duration,
+			Budget:         retriesConf.Budget.Duration,
+		}
+	}
+	return multiTransport
+}
+
+func (st Storages) newMultiBackendCluster(transp http.RoundTripper,
 	multiResponseHandler transport.MultipleResponsesHandler,
-	clusterConf shardingconfig.ClusterConfig, name string, maintainedBackends []shardingconfig.YAMLUrl) Cluster {
+	clusterConf shardingconfig.ClusterConfig, name string) (Cluster, error) {
 	backends := make([]url.URL, len(clusterConf.Backends))
 
 	for i, backend := range clusterConf.Backends {
 		backends[i] = *backend.URL
 	}
 
-	multiTransport := transport.NewMultiTransport(
+	multiTransport := st.NewMultiTransport(
 		transp,
 		backends,
-		multiResponseHandler,
-		maintainedBackends)
+		multiResponseHandler)
+	if st.Health != nil {
+		st.Health.AddBackends(transp, backends)
+	}
+
+	readPolicy, err := transport.NewReadPolicy(clusterConf.ReadPolicy, clusterConf.PreferredZone, clusterConf.BackendZones)
+	if err != nil {
+		return Cluster{}, fmt.Errorf("cluster %q: %s", name, err)
+	}
+	multiTransport.ReadPolicy = readPolicy
+
+	processor, err := clusterRequestProcessor(clusterConf)
+	if err != nil {
+		return Cluster{}, fmt.Errorf("cluster %q: %s", name, err)
+	}
+	multiTransport.PreProcessRequest = processor
+
+	hedgingConf := st.Conf.HedgedReads
+	if hedgingConf.Enabled {
+		multiTransport.Hedging = &transport.HedgedReads{
+			Delay:      hedgingConf.Delay.Duration,
+			Percentile: hedgingConf.Percentile,
+		}
+	}
+
+	if clusterConf.AsyncReplication {
+		if st.Replication == nil {
+			return Cluster{}, fmt.Errorf("cluster %q: AsyncReplication requires replication queue to be enabled", name)
+		}
+		multiTransport.Async = st.Replication.ForCluster(name, backends, transp, multiTransport.PreProcessRequest)
+	}
+
+	if st.Multipart != nil {
+		st.Multipart.ForCluster(multiTransport, clusterConf.Credentials.AccessKey != "")
+	}
 
 	return Cluster{
 		multiTransport,
 		clusterConf.Backends,
 		name,
-	}
+	}, nil
 }
 
 func (st Storages) initCluster(name string) (Cluster, error) {
@@ -53,7 +138,247 @@ func (st Storages) initCluster(name string) (Cluster, error) {
 		return Cluster{}, fmt.Errorf("no cluster %q in configuration", name)
 	}
 	respHandler := httphandler.EarliestResponseHandler(st.Conf)
-	return newMultiBackendCluster(st.Transport, respHandler, clusterConf, name, st.Conf.MaintainedBackends), nil
+	if clusterConf.WriteQuorum > 0 {
+		respHandler = httphandler.QuorumResponseHandler(st.Conf, clusterConf.WriteQuorum)
+	}
+	transp, err := st.clusterRoundTripper(clusterConf)
+	if err != nil {
+		return Cluster{}, fmt.Errorf("cluster %q: %s", name, err)
+	}
+	return st.newMultiBackendCluster(transp, respHandler, clusterConf, name)
+}
+
+// clusterRoundTripper returns Storages.Transport, or dedicated transport
+// if cluster overrides transport settings
+func (st Storages) clusterRoundTripper(clusterConf shardingconfig.ClusterConfig) (http.RoundTripper, error) {
+	if clusterConf.Transport.IsEmpty() && len(clusterConf.BackendTransports) == 0 {
+		return st.Transport, nil
+	}
+	clusterTransport, err := httphandler.ConfigureClusterHTTPTransport(st.Conf, clusterConf.Transport)
+	if err != nil {
+		return nil, err
+	}
+	if len(clusterConf.BackendTransports) == 0 {
+		return clusterTransport, nil
+	}
+	hosts := make(map[string]http.RoundTripper, len(clusterConf.BackendTransports))
+	for host, backendConf := range clusterConf.BackendTransports {
+		backendTransport, err := httphandler.ConfigureClusterHTTPTransport(st.Conf, clusterConf.Transport, backendConf)
+		if err != nil {
+			return nil, err
+		}
+		hosts[host] = backendTransport
+	}
+	return &transport.HostRoundTripper{Default: clusterTransport, Hosts: hosts}, nil
+}
+
+// RegionRoundTripper returns round tripper which sends requests to backends
+// of region clusters with their transport settings, transp is used for
+// clusters without own settings
+func (st Storages) RegionRoundTripper(regionConf shardingconfig.RegionConfig, transp http.RoundTripper) (http.RoundTripper, error) {
+	hosts := make(map[string]http.RoundTripper)
+	for _, multiCluster := range regionConf.Clusters {
+		clusterConf, ok := st.Conf.Clusters[multiCluster.Cluster]
+		if !ok || clusterConf.Transport.IsEmpty() && len(clusterConf.BackendTransports) == 0 {
+			continue
+		}
+		clusterTransport, err := st.clusterRoundTripper(clusterConf)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %s", multiCluster.Cluster, err)
+		}
+		for _, backend := range clusterConf.Backends {
+			hosts[backend.Host] = clusterTransport
+		}
+	}
+	if len(hosts) == 0 {
+		return transp, nil
+	}
+	return &transport.HostRoundTripper{Default: transp, Hosts: hosts}, nil
+}
+
+// clusterRequestProcessor returns cluster processors chain, requests are
+// re-signed last if cluster has credentials
+func clusterRequestProcessor(clusterConf shardingconfig.ClusterConfig) (transport.RequestProcessor, error) {
+	processor, err := transport.NewRequestProcessor(clusterConf.RequestProcessors)
+	if err != nil {
+		return nil, err
+	}
+	if clusterConf.AddressingStyle == transport.VirtualHostedStyle {
+		processor = transport.ChainProcessors(processor, transport.VirtualHostedStyleProcessor())
+	}
+	credentials := clusterConf.Credentials
+	if credentials.AccessKey == "" {
+		return processor, nil
+	}
+	signer := signature.NewSigner(signature.Credentials{
+		AccessKey: credentials.AccessKey,
+		SecretKey: credentials.SecretKey,
+		Region:    credentials.Region,
+	})
+	return transport.ChainProcessors(processor, signer.Process), nil
+}
+
+// RegionRequestProcessor returns processor of requests sent to all region
+// backends, region processors run first, then processors of cluster to
+// which backend belongs
+func (st Storages) RegionRequestProcessor(regionConf shardingconfig.RegionConfig) (transport.RequestProcessor, error) {
+	regionProcessor, err := transport.NewRequestProcessor(regionConf.RequestProcessors)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string]transport.RequestProcessor)
+	for _, multiCluster := range regionConf.Clusters {
+		clusterConf, ok := st.Conf.Clusters[multiCluster.Cluster]
+		if !ok {
+			continue
+		}
+		clusterProcessor, err := clusterRequestProcessor(clusterConf)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %q: %s", multiCluster.Cluster, err)
+		}
+		if clusterProcessor == nil {
+			continue
+		}
+		for _, backend := range clusterConf.Backends {
+			hosts[backend.Host] = clusterProcessor
+		}
+	}
+	return transport.ChainProcessors(regionProcessor, transport.HostProcessors(hosts)), nil
+}
+
+// NewCircuitBreakers creates backend circuit breakers from configuration,
+// returns nil if breakers are disabled
+func NewCircuitBreakers(conf config.Config) *transport.CircuitBreakers {
+	breakerConf := conf.CircuitBreaker
+	if !breakerConf.Enabled {
+		return nil
+	}
+	errorRate := 0.0
+	if breakerConf.ErrorRate != nil {
+		errorRate = *breakerConf.ErrorRate
+	}
+	return transport.NewCircuitBreakers(transport.CircuitBreakerConfig{
+		ErrorRate:        errorRate,
+		LatencyThreshold: breakerConf.LatencyThreshold.Duration,
+		MinRequests:      breakerConf.MinRequests,
+		Window:           breakerConf.Window.Duration,
+		OpenDuration:     breakerConf.OpenDuration.Duration,
+		HalfOpenProbes:   breakerConf.HalfOpenProbes,
+	})
+}
+
+// NewHealthChecker creates backend health checker from configuration,
+// returns nil if health checking is disabled
+func NewHealthChecker(conf config.Config) *transport.HealthChecker {
+	healthConf := conf.BackendHealthCheck
+	if !healthConf.Enabled {
+		return nil
+	}
+	return transport.NewHealthChecker(transport.HealthCheckConfig{
+		Path:             healthConf.Path,
+		Interval:         healthConf.Interval.Duration,
+		Timeout:          healthConf.Timeout.Duration,
+		FailureThreshold: healthConf.FailureThreshold,
+		SuccessThreshold: healthConf.SuccessThreshold,
+	})
+}
+
+// NewBulkheads creates per backend concurrent requests limits from
+// configuration, returns nil if there is no limit
+func NewBulkheads(conf config.Config) *transport.Bulkheads {
+	if conf.MaxConcurrentRequestsPerBackend <= 0 {
+		return nil
+	}
+	return transport.NewBulkheads(conf.MaxConcurrentRequestsPerBackend)
+}
+
+// NewBodySpill creates request body spill from configuration and removes
+// files left in spill directory, returns nil if spill is disabled
+func NewBodySpill(conf config.Config) (*transport.BodySpill, error) {
+	spillConf := conf.BodySpill
+	if !spillConf.Enabled {
+		return nil, nil
+	}
+	if err := transport.CleanupSpillDir(spillConf.Dir); err != nil {
+		return nil, fmt.Errorf("cannot cleanup body spill directory: %s", err)
+	}
+	return &transport.BodySpill{
+		Threshold: spillConf.Threshold.SizeInBytes,
+		Dir:       spillConf.Dir,
+		MaxSize:   spillConf.MaxSize.SizeInBytes,
+	}, nil
+}
+
+// NewReplicationQueue creates async replication queue from configuration,
+// writes dropped by queue are logged to synclog. Returns nil if replication
+// queue is disabled
+func NewReplicationQueue(conf config.Config) (*transport.ReplicationQueue, error) {
+	replicationConf := conf.AsyncReplication
+	if !replicationConf.Enabled {
+		return nil, nil
+	}
+	queue, err := transport.NewReplicationQueue(transport.ReplicationQueueConfig{
+		Dir:           replicationConf.Dir,
+		Workers:       replicationConf.Workers,
+		MaxAttempts:   replicationConf.MaxAttempts,
+		RetryInterval: replicationConf.RetryInterval.Duration,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open replication queue: %s", err)
+	}
+	queue.Dropped = func(failure transport.ReplicationFailure) {
+		if conf.Synclog == nil {
+			return
+		}
+		syncLogMsg := httphandler.NewSyncLogMessageData(
+			failure.Method,
+			failure.Host,
+			failure.Path,
+			failure.SuccessHost,
+			failure.UserAgent,
+			failure.ReqID,
+			"Async replication failed: "+failure.Error,
+			failure.ContentLength)
+		logMsg, err := json.Marshal(syncLogMsg)
+		if err != nil {
+			return
+		}
+		conf.Synclog.Println(string(logMsg))
+	}
+	return queue, nil
+}
+
+// NewMultipartUploads creates multipart uploads coordinator from
+// configuration, returns nil if it's disabled
+func NewMultipartUploads(conf config.Config) (*transport.MultipartUploads, error) {
+	multipartConf := conf.MultipartUploads
+	if !multipartConf.Enabled {
+		return nil, nil
+	}
+	multipart, err := transport.NewMultipartUploads(multipartConf.Dir, multipartConf.UploadTTL.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load multipart uploads: %s", err)
+	}
+	multipart.Abandoned = func(failure transport.MultipartAbortFailure) {
+		if conf.Synclog == nil {
+			return
+		}
+		syncLogMsg := httphandler.NewSyncLogMessageData(
+			http.MethodDelete,
+			failure.Host,
+			failure.Path+"?uploadId="+url.QueryEscape(failure.UploadID),
+			"",
+			"",
+			"",
+			"Expired multipart upload not aborted: "+failure.Error,
+			0)
+		logMsg, err := json.Marshal(syncLogMsg)
+		if err != nil {
+			return
+		}
+		conf.Synclog.Println(string(logMsg))
+	}
+	return multipart, nil
 }
 
 //GetCluster gets cluster by name or nil if cluster with given name was not found
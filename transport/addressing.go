@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	// PathStyle addresses bucket in first path segment
+	PathStyle = "path"
+	// VirtualHostedStyle addresses bucket in host name
+	VirtualHostedStyle = "virtual-hosted"
+)
+
+// S3Address is bucket and key addressed by request
+type S3Address struct {
+	Bucket string
+	Key    string
+	// Domain is longest of domains matching request host, empty if none
+	// matches
+	Domain string
+	// VirtualHosted is set if bucket is given in host name
+	VirtualHosted bool
+}
+
+// ParseS3Address extracts bucket and key from path-style or virtual-hosted
+// request. Host equal to one of domains addresses bucket in path, host in
+// subdomain of domain addresses bucket given by subdomain, which may contain
+// dots. Hosts not matching any domain are treated as path-style.
+func ParseS3Address(host, path string, domains []string) S3Address {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(host)
+	address := S3Address{}
+	for _, domain := range domains {
+		lowerDomain := strings.ToLower(domain)
+		if len(domain) <= len(address.Domain) {
+			continue
+		}
+		if host == lowerDomain {
+			address = S3Address{Domain: domain}
+			continue
+		}
+		if strings.HasSuffix(host, "."+lowerDomain) {
+			address = S3Address{
+				Domain:        domain,
+				Bucket:        strings.TrimSuffix(host, "."+lowerDomain),
+				VirtualHosted: true,
+			}
+		}
+	}
+	trimmedPath := strings.TrimPrefix(path, "/")
+	if address.VirtualHosted {
+		address.Key = trimmedPath
+		return address
+	}
+	address.Bucket = trimmedPath
+	if i := strings.Index(trimmedPath, "/"); i >= 0 {
+		address.Bucket = trimmedPath[:i]
+		address.Key = trimmedPath[i+1:]
+	}
+	return address
+}
+
+// Path returns path-style path of address
+func (address S3Address) Path() string {
+	if address.Key == "" {
+		return "/" + address.Bucket
+	}
+	return "/" + address.Bucket + "/" + address.Key
+}
+
+// dnsCompatibleBucket matches bucket names which can be used in host name
+var dnsCompatibleBucket = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+// VirtualHostedStyleProcessor returns RequestProcessor moving bucket from
+// path-style path of copies to host name. Buckets which can't be used in
+// host name are left in path.
+func VirtualHostedStyleProcessor() RequestProcessor {
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			escapedPath := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+			path := strings.TrimPrefix(r.URL.Path, "/")
+			bucket, key := path, ""
+			if i := strings.Index(path, "/"); i >= 0 {
+				bucket, key = path[:i], path[i+1:]
+			}
+			if !dnsCompatibleBucket.MatchString(bucket) || strings.Contains(bucket, "..") {
+				continue
+			}
+			escapedKey := ""
+			if i := strings.Index(escapedPath, "/"); i >= 0 {
+				escapedKey = escapedPath[i+1:]
+			}
+			r.Host = bucket + "." + r.URL.Host
+			r.URL.Path = "/" + key
+			r.URL.RawPath = "/" + escapedKey
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseS3Address(t *testing.T) {
+	domains := []string{"s3.example.com", "example.com", "storage.internal"}
+	for _, tc := range []struct {
+		host, path string
+		expected   S3Address
+	}{
+		{"s3.example.com", "/bucket/dir/key", S3Address{Bucket: "bucket", Key: "dir/key", Domain: "s3.example.com"}},
+		{"s3.example.com:8080", "/bucket", S3Address{Bucket: "bucket", Domain: "s3.example.com"}},
+		{"bucket.s3.example.com", "/dir/key", S3Address{Bucket: "bucket", Key: "dir/key", Domain: "s3.example.com", VirtualHosted: true}},
+		{"my.dotted.bucket.s3.example.com", "/key", S3Address{Bucket: "my.dotted.bucket", Key: "key", Domain: "s3.example.com", VirtualHosted: true}},
+		{"bucket.example.com", "/", S3Address{Bucket: "bucket", Domain: "example.com", VirtualHosted: true}},
+		{"Bucket.Storage.Internal:9000", "/key", S3Address{Bucket: "bucket", Key: "key", Domain: "storage.internal", VirtualHosted: true}},
+		{"other.host", "/bucket/key", S3Address{Bucket: "bucket", Key: "key"}},
+		{"notexample.com", "/bucket/key", S3Address{Bucket: "bucket", Key: "key"}},
+	} {
+		assert.Equal(t, tc.expected, ParseS3Address(tc.host, tc.path, domains), tc.host+tc.path)
+	}
+}
+
+func TestS3AddressPath(t *testing.T) {
+	assert.Equal(t, "/bucket/dir/key", S3Address{Bucket: "bucket", Key: "dir/key", VirtualHosted: true}.Path())
+	assert.Equal(t, "/bucket", S3Address{Bucket: "bucket", VirtualHosted: true}.Path())
+}
+
+func TestVirtualHostedStyleProcessorMovesBucketToHost(t *testing.T) {
+	orig, _ := http.NewRequest("GET", "http://akubra/my.bucket/dir/a%2Fb", nil)
+	backendReq, _ := http.NewRequest("GET", "http://backend:9000/my.bucket/dir/a%2Fb?acl", nil)
+
+	VirtualHostedStyleProcessor()(orig, []*http.Request{backendReq})
+
+	assert.Equal(t, "my.bucket.backend:9000", backendReq.Host)
+	assert.Equal(t, "backend:9000", backendReq.URL.Host)
+	assert.Equal(t, "http://backend:9000/dir/a%2Fb?acl", backendReq.URL.String())
+}
+
+func TestVirtualHostedStyleProcessorKeepsNotDNSCompatibleBucketsInPath(t *testing.T) {
+	orig, _ := http.NewRequest("GET", "http://akubra/My_Bucket/key", nil)
+	backendReq, _ := http.NewRequest("GET", "http://backend/My_Bucket/key", nil)
+
+	VirtualHostedStyleProcessor()(orig, []*http.Request{backendReq})
+
+	assert.Equal(t, "backend", backendReq.Host)
+	assert.Equal(t, "/My_Bucket/key", backendReq.URL.Path)
+}
@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ErrCircuitOpen is returned for requests not sent because backend
+// circuit breaker is open
+var ErrCircuitOpen = errors.New("Backend circuit breaker is open")
+
+// BreakerState is circuit breaker state
+type BreakerState int
+
+const (
+	// BreakerClosed passes all requests
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen passes limited number of probe requests
+	BreakerHalfOpen
+	// BreakerOpen rejects all requests
+	BreakerOpen
+)
+
+func (bs BreakerState) String() string {
+	switch bs {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+const (
+	defaultBreakerErrorRate      = 0.5
+	defaultBreakerMinRequests    = 10
+	defaultBreakerWindow         = 10 * time.Second
+	defaultBreakerOpenDuration   = 30 * time.Second
+	defaultBreakerHalfOpenProbes = 1
+)
+
+// CircuitBreakerConfig defines when backend circuit breaker opens and
+// how it recovers
+type CircuitBreakerConfig struct {
+	// ErrorRate (0-1] of failed requests in Window which opens breaker,
+	// default 0.5
+	ErrorRate float64
+	// LatencyThreshold if not zero, slower requests count as failed
+	LatencyThreshold time.Duration
+	// MinRequests in Window required before ErrorRate is evaluated
+	MinRequests int
+	// Window is length of period requests are counted in
+	Window time.Duration
+	// OpenDuration is time after which open breaker lets probes through
+	OpenDuration time.Duration
+	// HalfOpenProbes is number of successful probes which close breaker
+	HalfOpenProbes int
+}
+
+func (cbc CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	if cbc.ErrorRate <= 0 {
+		cbc.ErrorRate = defaultBreakerErrorRate
+	}
+	if cbc.MinRequests <= 0 {
+		cbc.MinRequests = defaultBreakerMinRequests
+	}
+	if cbc.Window <= 0 {
+		cbc.Window = defaultBreakerWindow
+	}
+	if cbc.OpenDuration <= 0 {
+		cbc.OpenDuration = defaultBreakerOpenDuration
+	}
+	if cbc.HalfOpenProbes <= 0 {
+		cbc.HalfOpenProbes = defaultBreakerHalfOpenProbes
+	}
+	return cbc
+}
+
+// CircuitBreaker tracks single backend host failures
+type CircuitBreaker struct {
+	host  string
+	conf  CircuitBreakerConfig
+	mx    sync.Mutex
+	state BreakerState
+	// closed state window counters
+	windowStart time.Time
+	requests    int
+	failures    int
+	// open state start
+	openedAt time.Time
+	// half-open state counters
+	probesInFlight int
+	probeSuccesses int
+	now            func() time.Time
+}
+
+func newCircuitBreaker(host string, conf CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		host: host,
+		conf: conf.withDefaults(),
+		now:  time.Now,
+	}
+}
+
+// State returns current breaker state
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	return cb.state
+}
+
+// Allow reports if request may be sent to backend. Every allowed
+// request has to be followed by Record or Cancel call.
+func (cb *CircuitBreaker) Allow() bool {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	switch cb.state {
+	case BreakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.conf.OpenDuration {
+			return false
+		}
+		cb.transition(BreakerHalfOpen)
+		fallthrough
+	case BreakerHalfOpen:
+		if cb.probesInFlight+cb.probeSuccesses >= cb.conf.HalfOpenProbes {
+			return false
+		}
+		cb.probesInFlight++
+	}
+	return true
+}
+
+// Record registers allowed request result
+func (cb *CircuitBreaker) Record(success bool, latency time.Duration) {
+	if cb.conf.LatencyThreshold > 0 && latency > cb.conf.LatencyThreshold {
+		success = false
+	}
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	switch cb.state {
+	case BreakerClosed:
+		now := cb.now()
+		if now.Sub(cb.windowStart) > cb.conf.Window {
+			cb.windowStart = now
+			cb.requests = 0
+			cb.failures = 0
+		}
+		cb.requests++
+		if !success {
+			cb.failures++
+		}
+		if cb.requests >= cb.conf.MinRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.conf.ErrorRate {
+			cb.transition(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		cb.probesInFlight--
+		if !success {
+			cb.transition(BreakerOpen)
+			return
+		}
+		cb.probeSuccesses++
+		if cb.probeSuccesses >= cb.conf.HalfOpenProbes {
+			cb.transition(BreakerClosed)
+		}
+	}
+}
+
+// Cancel registers allowed request abandoned before backend responded, it
+// counts neither as success nor as failure
+func (cb *CircuitBreaker) Cancel() {
+	cb.mx.Lock()
+	defer cb.mx.Unlock()
+	if cb.state == BreakerHalfOpen {
+		cb.probesInFlight--
+	}
+}
+
+// transition must be called with mx locked
+func (cb *CircuitBreaker) transition(state BreakerState) {
+	log.Printf("Backend %s circuit breaker changed state from %s to %s", cb.host, cb.state, state)
+	cb.state = state
+	cb.requests = 0
+	cb.failures = 0
+	cb.windowStart = cb.now()
+	cb.probesInFlight = 0
+	cb.probeSuccesses = 0
+	if state == BreakerOpen {
+		cb.openedAt = cb.now()
+	}
+	host := metrics.Clean(cb.host)
+	metrics.Mark(fmt.Sprintf("backends.%s.breaker.%s", host, state))
+	metrics.UpdateGauge(fmt.Sprintf("backends.%s.breaker.state", host), int64(state))
+}
+
+// CircuitBreakers holds circuit breakers of all backend hosts, breakers
+// are shared by all MultiTransports sending to given host
+type CircuitBreakers struct {
+	conf     CircuitBreakerConfig
+	mx       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewCircuitBreakers creates CircuitBreakers
+func NewCircuitBreakers(conf CircuitBreakerConfig) *CircuitBreakers {
+	return &CircuitBreakers{
+		conf:     conf,
+		breakers: make(map[string]*CircuitBreaker),
+	}
+}
+
+// Get returns breaker for backend host, creates one if needed
+func (cbs *CircuitBreakers) Get(host string) *CircuitBreaker {
+	cbs.mx.Lock()
+	defer cbs.mx.Unlock()
+	breaker, ok := cbs.breakers[host]
+	if !ok {
+		breaker = newCircuitBreaker(host, cbs.conf)
+		cbs.breakers[host] = breaker
+	}
+	return breaker
+}
@@ -0,0 +1,99 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	return fc.now
+}
+
+func mkBreaker(conf CircuitBreakerConfig) (*CircuitBreaker, *fakeClock) {
+	clock := &fakeClock{time.Now()}
+	cb := newCircuitBreaker("backend:80", conf)
+	cb.now = clock.Now
+	return cb, clock
+}
+
+func TestBreakerOpensOnErrorRate(t *testing.T) {
+	cb, _ := mkBreaker(CircuitBreakerConfig{ErrorRate: 0.5, MinRequests: 4})
+	for i := 0; i < 3; i++ {
+		assert.True(t, cb.Allow())
+		cb.Record(i == 0, time.Millisecond)
+	}
+	assert.Equal(t, BreakerClosed, cb.State(), "MinRequests not reached yet")
+	assert.True(t, cb.Allow())
+	cb.Record(false, time.Millisecond)
+	assert.Equal(t, BreakerOpen, cb.State())
+	assert.False(t, cb.Allow())
+}
+
+func TestBreakerCountsSlowRequestsAsFailures(t *testing.T) {
+	cb, _ := mkBreaker(CircuitBreakerConfig{ErrorRate: 1, MinRequests: 1, LatencyThreshold: time.Second})
+	assert.True(t, cb.Allow())
+	cb.Record(true, 2*time.Second)
+	assert.Equal(t, BreakerOpen, cb.State())
+}
+
+func TestBreakerHalfOpensAndCloses(t *testing.T) {
+	cb, clock := mkBreaker(CircuitBreakerConfig{ErrorRate: 1, MinRequests: 1, OpenDuration: time.Minute, HalfOpenProbes: 2})
+	cb.Allow()
+	cb.Record(false, time.Millisecond)
+	assert.False(t, cb.Allow())
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.True(t, cb.Allow(), "First probe should pass")
+	assert.Equal(t, BreakerHalfOpen, cb.State())
+	assert.True(t, cb.Allow(), "Second probe should pass")
+	assert.False(t, cb.Allow(), "Only configured number of probes should pass")
+	cb.Record(true, time.Millisecond)
+	cb.Record(true, time.Millisecond)
+	assert.Equal(t, BreakerClosed, cb.State())
+}
+
+func TestBreakerReopensOnFailedProbe(t *testing.T) {
+	cb, clock := mkBreaker(CircuitBreakerConfig{ErrorRate: 1, MinRequests: 1, OpenDuration: time.Minute})
+	cb.Allow()
+	cb.Record(false, time.Millisecond)
+	clock.now = clock.now.Add(time.Minute)
+	assert.True(t, cb.Allow())
+	cb.Record(false, time.Millisecond)
+	assert.Equal(t, BreakerOpen, cb.State())
+	assert.False(t, cb.Allow())
+}
+
+func TestMultiTransportSkipsBackendWithOpenBreaker(t *testing.T) {
+	urls := []url.URL{{Scheme: "http", Host: "broken"}}
+	calls := 0
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody}, nil
+	})
+	transp := mkTransportWithRoundTripper(urls, rt, t)
+	transp.Breakers = NewCircuitBreakers(CircuitBreakerConfig{ErrorRate: 1, MinRequests: 1})
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	_, err := transp.RoundTrip(req)
+	assert.NoError(t, err)
+	req, _ = http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	_, err = transp.RoundTrip(req)
+	assert.Equal(t, ErrCircuitOpen, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestBreakerWithDefaultErrorRateStaysClosedOnSuccesses(t *testing.T) {
+	cb, _ := mkBreaker(CircuitBreakerConfig{})
+	for i := 0; i < 3*defaultBreakerMinRequests; i++ {
+		assert.True(t, cb.Allow())
+		cb.Record(true, time.Millisecond)
+	}
+	assert.Equal(t, BreakerClosed, cb.State())
+}
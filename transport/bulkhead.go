@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// ErrBulkheadFull is returned for requests not sent because backend has
+// too many requests in progress
+var ErrBulkheadFull = errors.New("Backend concurrent requests limit reached")
+
+// Bulkheads limit number of requests in progress per backend host, limits
+// are shared by all MultiTransports sending to given host
+type Bulkheads struct {
+	limit    int32
+	mx       sync.Mutex
+	inFlight map[string]*int32
+}
+
+// NewBulkheads creates Bulkheads with limit of requests per backend host
+func NewBulkheads(limit int) *Bulkheads {
+	return &Bulkheads{
+		limit:    int32(limit),
+		inFlight: make(map[string]*int32),
+	}
+}
+
+func (bh *Bulkheads) counter(host string) *int32 {
+	bh.mx.Lock()
+	defer bh.mx.Unlock()
+	counter, ok := bh.inFlight[host]
+	if !ok {
+		counter = new(int32)
+		bh.inFlight[host] = counter
+	}
+	return counter
+}
+
+// Acquire reserves request slot for host, returns false if limit is
+// reached. Every successful Acquire has to be followed by Release.
+func (bh *Bulkheads) Acquire(host string) bool {
+	counter := bh.counter(host)
+	inFlight := atomic.AddInt32(counter, 1)
+	if inFlight > bh.limit {
+		atomic.AddInt32(counter, -1)
+		metrics.Mark(fmt.Sprintf("backends.%s.bulkhead.rejected", metrics.Clean(host)))
+		return false
+	}
+	metrics.UpdateGauge(fmt.Sprintf("backends.%s.bulkhead.inflight", metrics.Clean(host)), int64(inFlight))
+	return true
+}
+
+// Release frees request slot for host
+func (bh *Bulkheads) Release(host string) {
+	inFlight := atomic.AddInt32(bh.counter(host), -1)
+	metrics.UpdateGauge(fmt.Sprintf("backends.%s.bulkhead.inflight", metrics.Clean(host)), int64(inFlight))
+}
+
+// releasingBody frees bulkhead slot once response body is read or closed,
+// connection is busy until then
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (rb *releasingBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	if err != nil {
+		rb.once.Do(rb.release)
+	}
+	return n, err
+}
+
+func (rb *releasingBody) Close() error {
+	err := rb.ReadCloser.Close()
+	rb.once.Do(rb.release)
+	return err
+}
+
+// holdUntilBodyRead makes resp body release bulkhead slot, slot is
+// released at once if there is no body
+func (bh *Bulkheads) holdUntilBodyRead(host string, resp *http.Response) {
+	release := func() { bh.Release(host) }
+	if resp == nil || resp.Body == nil {
+		release()
+		return
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+}
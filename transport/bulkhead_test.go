@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkheadsLimitRequestsPerHost(t *testing.T) {
+	bulkheads := NewBulkheads(2)
+	assert.True(t, bulkheads.Acquire("a"))
+	assert.True(t, bulkheads.Acquire("a"))
+	assert.False(t, bulkheads.Acquire("a"))
+	assert.True(t, bulkheads.Acquire("b"), "Other hosts should not be affected")
+	bulkheads.Release("a")
+	assert.True(t, bulkheads.Acquire("a"))
+}
+
+func TestMultiTransportFailsFastOnFullBulkhead(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("content")), Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a"), rt, t)
+	transp.Bulkheads = NewBulkheads(1)
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+
+	req, _ = http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	_, err = transp.RoundTrip(req)
+	assert.Equal(t, ErrBulkheadFull, err, "Slot should be held until body is read")
+
+	_, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	_, err = transp.RoundTrip(req)
+	assert.NoError(t, err)
+}
+
+type closeNotifyingBody struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (cnb *closeNotifyingBody) Close() error {
+	close(cnb.closed)
+	return nil
+}
+
+func TestAbandonedRequestReleasesBulkheadSlot(t *testing.T) {
+	respond := make(chan struct{})
+	closed := make(chan struct{})
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-respond
+		body := &closeNotifyingBody{Reader: strings.NewReader("late"), closed: closed}
+		return &http.Response{StatusCode: http.StatusOK, Body: body, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a"), rt, t)
+	transp.Bulkheads = NewBulkheads(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "http://a/bucket/key", nil)
+	out := make(chan ReqResErrTuple, 1)
+
+	go transp.sendRequest(req.WithContext(ctx), out)
+	cancel()
+	<-out
+	close(respond)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Abandoned response body should be closed")
+	}
+	assert.True(t, transp.Bulkheads.Acquire("a"))
+}
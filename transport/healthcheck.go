@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+// ErrBackendUnavailable is returned for requests not sent because backend
+// failed health checks
+var ErrBackendUnavailable = errors.New("Backend marked unavailable by health check")
+
+const (
+	defaultHealthCheckPath             = "/"
+	defaultHealthCheckInterval         = 5 * time.Second
+	defaultHealthCheckTimeout          = 2 * time.Second
+	defaultHealthCheckFailureThreshold = 3
+	defaultHealthCheckSuccessThreshold = 2
+)
+
+// HealthCheckConfig defines how backends are probed
+type HealthCheckConfig struct {
+	// Path requested on every backend
+	Path string
+	// Interval between probes
+	Interval time.Duration
+	// Timeout of single probe
+	Timeout time.Duration
+	// FailureThreshold is number of consecutive failed probes which
+	// mark backend unavailable
+	FailureThreshold int
+	// SuccessThreshold is number of consecutive successful probes which
+	// mark backend available again
+	SuccessThreshold int
+}
+
+func (hcc HealthCheckConfig) withDefaults() HealthCheckConfig {
+	if hcc.Path == "" {
+		hcc.Path = defaultHealthCheckPath
+	}
+	if hcc.Interval <= 0 {
+		hcc.Interval = defaultHealthCheckInterval
+	}
+	if hcc.Timeout <= 0 {
+		hcc.Timeout = defaultHealthCheckTimeout
+	}
+	if hcc.FailureThreshold <= 0 {
+		hcc.FailureThreshold = defaultHealthCheckFailureThreshold
+	}
+	if hcc.SuccessThreshold <= 0 {
+		hcc.SuccessThreshold = defaultHealthCheckSuccessThreshold
+	}
+	return hcc
+}
+
+type backendHealth struct {
+	backend      url.URL
+	roundTripper http.RoundTripper
+	available    bool
+	failures     int
+	successes    int
+}
+
+// HealthChecker periodically probes backends and tracks their availability
+type HealthChecker struct {
+	conf     HealthCheckConfig
+	mx       sync.RWMutex
+	backends map[string]*backendHealth
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewHealthChecker creates HealthChecker, backends are registered with
+// AddBackends and probed after Start
+func NewHealthChecker(conf HealthCheckConfig) *HealthChecker {
+	return &HealthChecker{
+		conf:     conf.withDefaults(),
+		backends: make(map[string]*backendHealth),
+		stop:     make(chan struct{}),
+	}
+}
+
+// AddBackends registers backends probed with given roundTripper, backends
+// already registered are ignored
+func (hc *HealthChecker) AddBackends(roundTripper http.RoundTripper, backends []url.URL) {
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	for _, backend := range backends {
+		if _, ok := hc.backends[backend.Host]; ok {
+			continue
+		}
+		hc.backends[backend.Host] = &backendHealth{
+			backend:      backend,
+			roundTripper: roundTripper,
+			available:    true,
+		}
+	}
+}
+
+// Available reports if backend host passes health checks, hosts not
+// registered are always available
+func (hc *HealthChecker) Available(host string) bool {
+	hc.mx.RLock()
+	defer hc.mx.RUnlock()
+	bh, ok := hc.backends[host]
+	return !ok || bh.available
+}
+
+// AnyAvailable reports if at least one of given hosts is available
+func (hc *HealthChecker) AnyAvailable(hosts []string) bool {
+	for _, host := range hosts {
+		if hc.Available(host) {
+			return true
+		}
+	}
+	return len(hosts) == 0
+}
+
+// Start runs probing loop in background
+func (hc *HealthChecker) Start() {
+	go func() {
+		ticker := time.NewTicker(hc.conf.Interval)
+		defer ticker.Stop()
+		for {
+			hc.CheckAll()
+			select {
+			case <-ticker.C:
+			case <-hc.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates probing loop
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() { close(hc.stop) })
+}
+
+// CheckAll probes all registered backends once
+func (hc *HealthChecker) CheckAll() {
+	hc.mx.RLock()
+	targets := make([]*backendHealth, 0, len(hc.backends))
+	for _, bh := range hc.backends {
+		targets = append(targets, bh)
+	}
+	hc.mx.RUnlock()
+
+	wg := sync.WaitGroup{}
+	for _, target := range targets {
+		wg.Add(1)
+		go func(bh *backendHealth) {
+			defer wg.Done()
+			hc.update(bh, hc.probe(bh))
+		}(target)
+	}
+	wg.Wait()
+}
+
+func (hc *HealthChecker) probe(bh *backendHealth) error {
+	probeURL := bh.backend
+	probeURL.Path = hc.conf.Path
+	req, err := http.NewRequest(http.MethodGet, probeURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.conf.Timeout)
+	defer cancel()
+	resp, err := bh.roundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_, discardErr := io.Copy(ioutil.Discard, resp.Body)
+	if discardErr != nil {
+		log.Debugf("Could not discard health check response body from %s: %s", bh.backend.Host, discardErr)
+	}
+	if closeErr := resp.Body.Close(); closeErr != nil {
+		log.Debugf("Could not close health check response body from %s: %s", bh.backend.Host, closeErr)
+	}
+	// Any response proves backend is running, even unauthorized one
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (hc *HealthChecker) update(bh *backendHealth, probeErr error) {
+	hc.mx.Lock()
+	defer hc.mx.Unlock()
+	host := metrics.Clean(bh.backend.Host)
+	if probeErr != nil {
+		bh.failures++
+		bh.successes = 0
+		metrics.Mark(fmt.Sprintf("backends.%s.health.failure", host))
+		if bh.available && bh.failures >= hc.conf.FailureThreshold {
+			bh.available = false
+			log.Printf("Backend %s marked unavailable, health check failed %d times, last error: %s",
+				bh.backend.Host, bh.failures, probeErr)
+		}
+	} else {
+		bh.successes++
+		bh.failures = 0
+		if !bh.available && bh.successes >= hc.conf.SuccessThreshold {
+			bh.available = true
+			log.Printf("Backend %s marked available, health check succeeded %d times",
+				bh.backend.Host, bh.successes)
+		}
+	}
+	available := int64(0)
+	if bh.available {
+		available = 1
+	}
+	metrics.UpdateGauge(fmt.Sprintf("backends.%s.health.available", host), available)
+}
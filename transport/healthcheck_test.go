@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckerMarksBackendUnavailableAndBack(t *testing.T) {
+	status := int32(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	backendURL, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	hc := NewHealthChecker(HealthCheckConfig{Path: "/health", FailureThreshold: 2, SuccessThreshold: 2})
+	hc.AddBackends(http.DefaultTransport, []url.URL{*backendURL})
+	assert.True(t, hc.Available(backendURL.Host), "Backends are available until probed")
+
+	hc.CheckAll()
+	assert.True(t, hc.Available(backendURL.Host), "Single failure is below threshold")
+	hc.CheckAll()
+	assert.False(t, hc.Available(backendURL.Host))
+	assert.False(t, hc.AnyAvailable([]string{backendURL.Host}))
+
+	// unauthorized response proves backend is alive
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	hc.CheckAll()
+	assert.False(t, hc.Available(backendURL.Host))
+	hc.CheckAll()
+	assert.True(t, hc.Available(backendURL.Host))
+}
+
+func TestMultiTransportSkipsUnavailableBackend(t *testing.T) {
+	urls := []url.URL{{Scheme: "http", Host: "127.0.0.1:1"}}
+	hc := NewHealthChecker(HealthCheckConfig{FailureThreshold: 1})
+	hc.AddBackends(http.DefaultTransport, urls)
+	hc.CheckAll()
+	transp := mkTransport(urls, t)
+	transp.Health = hc
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	_, err := transp.RoundTrip(req)
+	assert.Equal(t, ErrBackendUnavailable, err)
+}
@@ -0,0 +1,225 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	defaultHedgeDelay = 100 * time.Millisecond
+	// defaultHedgeLoserWait is how long request which lost is awaited
+	// before it's cancelled
+	defaultHedgeLoserWait = time.Second
+	// maxHedgeLoserDrain limits body of request which lost read to keep
+	// its connection
+	maxHedgeLoserDrain = 64 << 10
+)
+
+// HedgedReads defines when GET request is repeated on second backend
+type HedgedReads struct {
+	// Delay after which second request is sent, used when Percentile is
+	// zero or first backend latency is not measured yet
+	Delay time.Duration
+	// Percentile (0-1] of first backend latency after which second
+	// request is sent
+	Percentile float64
+	rr         roundRobinPolicy
+	// loserWait overrides defaultHedgeLoserWait
+	loserWait time.Duration
+}
+
+func (hr *HedgedReads) loserTimeout() time.Duration {
+	if hr.loserWait > 0 {
+		return hr.loserWait
+	}
+	return defaultHedgeLoserWait
+}
+
+func (hr *HedgedReads) delay(host string) time.Duration {
+	if hr.Percentile > 0 {
+		name := "reqs.backend." + metrics.Clean(host) + ".all"
+		if latency := time.Duration(metrics.TimerPercentile(name, hr.Percentile)); latency > 0 {
+			return latency
+		}
+	}
+	if hr.Delay > 0 {
+		return hr.Delay
+	}
+	return defaultHedgeDelay
+}
+
+type hedgedAttempt struct {
+	req    *http.Request
+	cancel context.CancelFunc
+	hedge  bool
+}
+
+type hedgedResult struct {
+	attempt *hedgedAttempt
+	tup     ReqResErrTuple
+}
+
+// hedgedRead sends request to first backend and, if it does not respond
+// within hedge delay, to second one. First successful response wins, other
+// request is awaited and its response body discarded. If both fail,
+// remaining backends are tried one by one.
+func (mt *MultiTransport) hedgedRead(req *http.Request, ctx context.Context) (*http.Response, error) {
+	all := mt.Backends
+	if mt.ReadPolicy != nil {
+		all = mt.ReadPolicy.Order(all)
+	} else {
+		all = mt.Hedging.rr.Order(all)
+	}
+	if len(all) == 0 {
+		return nil, errors.New("No requests provided")
+	}
+	backends := all
+	if len(backends) > 2 {
+		backends = backends[:2]
+	}
+
+	results := make(chan hedgedResult, len(backends))
+	attempts := make([]*hedgedAttempt, 0, len(backends))
+	start := func(backend url.URL, hedge bool) error {
+		r, err := newBackendRequest(req, backend, nil, 0)
+		if err != nil {
+			return err
+		}
+		mt.preProcess(req, r)
+		actx, cancel := context.WithCancel(ctx)
+		attempt := &hedgedAttempt{req: r.WithContext(ctx), cancel: cancel, hedge: hedge}
+		attempts = append(attempts, attempt)
+		go func() {
+			since := time.Now()
+			tup := mt.doRequest(attempt.req, actx)
+			collectMetrics(attempt.req, tup, since)
+			results <- hedgedResult{attempt, tup}
+		}()
+		return nil
+	}
+	if err := start(backends[0], false); err != nil {
+		return nil, err
+	}
+
+	var hedgeTimer <-chan time.Time
+	if len(backends) > 1 {
+		timer := time.NewTimer(mt.Hedging.delay(backends[0].Host))
+		defer timer.Stop()
+		hedgeTimer = timer.C
+	}
+
+	c := make(chan ReqResErrTuple, len(all))
+	succeeded := false
+	pending := 1
+	for pending > 0 {
+		select {
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			log.Debugf("Hedging request %s, on %s", ctx.Value(log.ContextreqIDKey), backends[1].Host)
+			metrics.Mark("reqs.hedged.fired")
+			if err := start(backends[1], true); err != nil {
+				log.Debugf("Could not hedge request %s: %s", ctx.Value(log.ContextreqIDKey), err)
+				continue
+			}
+			pending++
+		case res := <-results:
+			pending--
+			c <- res.tup
+			if !needsFailover(res.tup) {
+				if res.attempt.hedge {
+					metrics.Mark("reqs.hedged.won")
+				}
+				mt.discardHedgedLosers(attempts, results, pending)
+				succeeded = true
+				pending = 0
+				continue
+			}
+			// first backend failed before hedge delay, don't wait for it
+			if hedgeTimer != nil {
+				hedgeTimer = nil
+				if err := start(backends[1], false); err == nil {
+					pending++
+				}
+			}
+		}
+	}
+	if !succeeded {
+		mt.failoverRemaining(req, ctx, all[len(backends):], c)
+	}
+	close(c)
+	resTup := mt.HandleResponses(c)
+	return resTup.Res, resTup.Err
+}
+
+// failoverRemaining sends request to backends one by one until one of them
+// responds with neither error nor 404, responses are passed to c
+func (mt *MultiTransport) failoverRemaining(req *http.Request, ctx context.Context, backends []url.URL, c chan<- ReqResErrTuple) {
+	for _, backend := range backends {
+		log.Debugf("Hedged read request %s failed, trying %s", ctx.Value(log.ContextreqIDKey), backend.Host)
+		r, err := newBackendRequest(req, backend, nil, 0)
+		if err != nil {
+			c <- ReqResErrTuple{r, nil, err, true}
+			return
+		}
+		mt.preProcess(req, r)
+		attempt := make(chan ReqResErrTuple, 1)
+		mt.sendRequest(r.WithContext(ctx), attempt)
+		tup := <-attempt
+		c <- tup
+		if !needsFailover(tup) {
+			return
+		}
+	}
+}
+
+// discardHedgedLosers awaits requests still in flight in background and
+// discards their responses bodies, so connections can be reused. Requests
+// which don't respond in time and bodies above limit are given up.
+func (mt *MultiTransport) discardHedgedLosers(attempts []*hedgedAttempt, results <-chan hedgedResult, pending int) {
+	if pending == 0 {
+		return
+	}
+	timeout := mt.Hedging.loserTimeout()
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for i := 0; i < pending; i++ {
+			select {
+			case res := <-results:
+				res.attempt.cancel()
+				discardHedgedResponse(res.tup.Res)
+				continue
+			case <-timer.C:
+			}
+			for _, attempt := range attempts {
+				attempt.cancel()
+			}
+			for ; i < pending; i++ {
+				res := <-results
+				discardHedgedResponse(res.tup.Res)
+			}
+		}
+	}()
+}
+
+// discardHedgedResponse reads limited part of body, connection is reused if
+// whole body is read
+func discardHedgedResponse(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+	if _, err := io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxHedgeLoserDrain)); err != nil {
+		log.Debugf("Could not discard hedged response body %s", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Debugf("Could not close hedged response body %s", err)
+	}
+}
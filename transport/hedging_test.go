@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgedReadServesFasterBackend(t *testing.T) {
+	cancelled := make(chan string, 1)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow" {
+			select {
+			case <-req.Context().Done():
+				cancelled <- req.URL.Host
+				return nil, req.Context().Err()
+			case <-time.After(time.Second):
+			}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("slow", "fast"), rt, t)
+	transp.ReadPolicy = &leastLatencyPolicy{latency: func(host string) float64 { return 0 }}
+	transp.Hedging = &HedgedReads{Delay: 10 * time.Millisecond, loserWait: 10 * time.Millisecond}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "fast", resp.Request.URL.Host)
+	select {
+	case host := <-cancelled:
+		assert.Equal(t, "slow", host)
+	case <-time.After(time.Second):
+		t.Error("Slow request should be cancelled")
+	}
+}
+
+func TestHedgedReadFailsOverToRemainingBackends(t *testing.T) {
+	rt := &recordingRoundTripper{statuses: map[string]int{"a": 404, "b": 500, "c": 200}}
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b", "c"), rt, t)
+	transp.ReadPolicy = &leastLatencyPolicy{latency: func(host string) float64 { return 0 }}
+	transp.Hedging = &HedgedReads{Delay: time.Second}
+	transp.HandleResponses = func(in <-chan ReqResErrTuple) ReqResErrTuple {
+		var last ReqResErrTuple
+		for tup := range in {
+			if !needsFailover(tup) {
+				return tup
+			}
+			last = tup
+		}
+		return last
+	}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "c", resp.Request.URL.Host)
+	assert.Equal(t, []string{"a", "b", "c"}, rt.calls)
+}
+
+func TestHedgedReadLoserIsDrainedWithoutCancelling(t *testing.T) {
+	closed := make(chan struct{})
+	cancelled := make(chan struct{}, 1)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow" {
+			time.Sleep(50 * time.Millisecond)
+			if req.Context().Err() != nil {
+				cancelled <- struct{}{}
+			}
+			body := &closeNotifyingBody{Reader: strings.NewReader("late"), closed: closed}
+			return &http.Response{StatusCode: http.StatusOK, Body: body, Request: req}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("slow", "fast"), rt, t)
+	transp.ReadPolicy = &leastLatencyPolicy{latency: func(host string) float64 { return 0 }}
+	transp.Hedging = &HedgedReads{Delay: 10 * time.Millisecond}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, "fast", resp.Request.URL.Host)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Slow response body should be closed")
+	}
+	assert.Len(t, cancelled, 0)
+}
+
+func TestHedgedReadNotFiredForFastBackend(t *testing.T) {
+	rt := &recordingRoundTripper{statuses: map[string]int{"a": 200, "b": 200}}
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), rt, t)
+	transp.ReadPolicy = &leastLatencyPolicy{latency: func(host string) float64 { return 0 }}
+	transp.Hedging = &HedgedReads{Delay: time.Second}
+
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"a"}, rt.calls)
+}
+
+func TestCancelledHedgedLoserDoesNotPenalizeBackend(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		cancel()
+		return nil, errors.New("net/http: request canceled")
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("hedge-loser"), rt, t)
+	transp.Breakers = NewCircuitBreakers(CircuitBreakerConfig{ErrorRate: 1, MinRequests: 1})
+	transp.Retries = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	req, _ := http.NewRequest("GET", "http://hedge-loser/bucket/key", nil)
+	req = req.WithContext(WithRetriesCounter(context.Background()))
+
+	since := time.Now()
+	tup := transp.doRequest(req, ctx)
+	collectMetrics(req, tup, since)
+
+	assert.Equal(t, context.Canceled, tup.Err)
+	assert.Equal(t, int32(0), Retries(req.Context()))
+	assert.Equal(t, time.Duration(0), BackendLatency("hedge-loser"))
+	breaker := transp.Breakers.Get("hedge-loser")
+	assert.Equal(t, BreakerClosed, breaker.State())
+	assert.Equal(t, 0, breaker.requests)
+}
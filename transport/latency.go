@@ -0,0 +1,72 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// latencySmoothing is weight of newest sample in moving average, higher
+// values make average react faster to latency changes
+const latencySmoothing = 0.2
+
+// LatencyTracker keeps exponentially weighted moving average (EWMA) of
+// backend response header latency per host
+type LatencyTracker struct {
+	smoothing float64
+	mx        sync.Mutex
+	averages  map[string]float64
+}
+
+// NewLatencyTracker creates LatencyTracker, smoothing (0-1] is weight of
+// newest sample
+func NewLatencyTracker(smoothing float64) *LatencyTracker {
+	return &LatencyTracker{
+		smoothing: smoothing,
+		averages:  make(map[string]float64),
+	}
+}
+
+// backendLatencies is fed by all MultiTransports, backends are shared
+// between clusters and regions
+var backendLatencies = NewLatencyTracker(latencySmoothing)
+
+// Observe adds latency sample of host and publishes average as
+// backends.<host>.latency.ewma gauge in nanoseconds
+func (lt *LatencyTracker) Observe(host string, latency time.Duration) {
+	lt.mx.Lock()
+	average, ok := lt.averages[host]
+	if ok {
+		average += lt.smoothing * (float64(latency) - average)
+	} else {
+		average = float64(latency)
+	}
+	lt.averages[host] = average
+	lt.mx.Unlock()
+	metrics.UpdateGauge(fmt.Sprintf("backends.%s.latency.ewma", metrics.Clean(host)), int64(average))
+}
+
+// observeFailure adds sample of failed request, so backend failing fast
+// does not look faster than healthy ones. Sample is at least twice the
+// current average.
+func (lt *LatencyTracker) observeFailure(host string, latency time.Duration) {
+	if penalty := 2 * lt.Latency(host); latency < penalty {
+		latency = penalty
+	}
+	lt.Observe(host, latency)
+}
+
+// Latency returns host latency average, zero if host was not measured
+func (lt *LatencyTracker) Latency(host string) time.Duration {
+	lt.mx.Lock()
+	defer lt.mx.Unlock()
+	return time.Duration(lt.averages[host])
+}
+
+// BackendLatency returns moving average of backend host response header
+// latency, zero if backend was not measured yet
+func BackendLatency(host string) time.Duration {
+	return backendLatencies.Latency(host)
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyTrackerComputesMovingAverage(t *testing.T) {
+	tracker := NewLatencyTracker(0.5)
+	assert.Equal(t, time.Duration(0), tracker.Latency("a"))
+	tracker.Observe("a", 100*time.Millisecond)
+	assert.Equal(t, 100*time.Millisecond, tracker.Latency("a"), "First sample should be taken as is")
+	tracker.Observe("a", 200*time.Millisecond)
+	assert.Equal(t, 150*time.Millisecond, tracker.Latency("a"))
+	assert.Equal(t, time.Duration(0), tracker.Latency("b"))
+}
+
+func TestLatencyTrackerPenalizesFastFailures(t *testing.T) {
+	tracker := NewLatencyTracker(0.5)
+	tracker.Observe("a", 100*time.Millisecond)
+	tracker.observeFailure("a", time.Millisecond)
+	assert.Equal(t, 150*time.Millisecond, tracker.Latency("a"))
+}
+
+func TestBackendLatencyIsMeasured(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "latency-failing" {
+			return nil, errors.New("connection refused")
+		}
+		time.Sleep(5 * time.Millisecond)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("latency-slow", "latency-failing"), rt, t)
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", nil)
+	_, err := transp.RoundTrip(req)
+	assert.NoError(t, err)
+
+	// metrics are collected after response is passed
+	deadline := time.Now().Add(time.Second)
+	for (BackendLatency("latency-slow") == 0 || BackendLatency("latency-failing") == 0) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, BackendLatency("latency-slow") >= 5*time.Millisecond)
+	assert.True(t, BackendLatency("latency-failing") > 0, "Failures should be measured too")
+}
+
+func TestAbandonedRequestMetricsComeFromBackendResult(t *testing.T) {
+	respond := make(chan struct{})
+	closed := make(chan struct{})
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-respond
+		body := &closeNotifyingBody{Reader: strings.NewReader("late"), closed: closed}
+		return &http.Response{StatusCode: http.StatusOK, Body: body, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("abandoned"), rt, t)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "http://abandoned/bucket/key", nil)
+	out := make(chan ReqResErrTuple, 1)
+
+	go transp.sendRequest(req.WithContext(ctx), out)
+	cancel()
+	assert.Equal(t, ErrBodyContentLengthMismatch, (<-out).Err)
+	time.Sleep(10 * time.Millisecond)
+	close(respond)
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Abandoned response body should be closed")
+	}
+	assert.True(t, BackendLatency("abandoned") >= 10*time.Millisecond)
+	assert.Nil(t, gometrics.DefaultRegistry.Get("reqs.backend.abandoned.err"))
+	assert.NotNil(t, gometrics.DefaultRegistry.Get("reqs.backend.abandoned.status_200"))
+}
@@ -0,0 +1,723 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	multipartUploadSuffix = ".json"
+	multipartPartsSuffix  = ".parts"
+	// maxMultipartXMLSize limits size of multipart XML documents read by
+	// coordinator, complete request with 10000 parts is below 1M
+	maxMultipartXMLSize = 8 << 20
+	s3XMLNamespace      = "http://s3.amazonaws.com/doc/2006-03-01/"
+	// multipartExpiryInterval is interval of expired uploads checks
+	multipartExpiryInterval = time.Minute
+)
+
+// multipartUpload maps upload id issued to client to upload ids of backends
+type multipartUpload struct {
+	ID      string
+	Path    string
+	Created time.Time
+	// UploadIDs maps backend host to backend upload id
+	UploadIDs map[string]string
+	// ETags maps backend host to ETags of uploaded parts by part number
+	ETags map[string]map[int]string
+	// Authorization of initiate request, abort of expired upload is signed
+	// by cluster with the same signature version
+	Authorization string `json:",omitempty"`
+	// mx guards UploadIDs, ETags and upload files
+	mx sync.Mutex
+	// removed is set once upload is forgotten
+	removed bool
+}
+
+// partRecord is line of upload parts file, part ETags are appended there
+// instead of rewriting whole upload
+type partRecord struct {
+	Host       string
+	PartNumber int
+	ETag       string
+}
+
+// MultipartAbortFailure describes backend upload which expired, but could
+// not be aborted
+type MultipartAbortFailure struct {
+	Host     string
+	Path     string
+	UploadID string
+	Error    string
+}
+
+// multipartCluster is cluster transport used to abort expired uploads,
+// signed is set if cluster signs requests with own credentials
+type multipartCluster struct {
+	transport *MultiTransport
+	signed    bool
+}
+
+// MultipartUploads coordinates multipart uploads across backends. Client
+// gets upload id issued by akubra, which is replaced with backend upload
+// id in every backend request. Uploads are stored in directory, with part
+// ETags appended to separate file of upload, so they survive restarts.
+// Upload is forgotten once all its backends complete or abort it.
+type MultipartUploads struct {
+	dir string
+	ttl time.Duration
+	// mx guards uploads map and clusters, uploads have their own locks
+	mx       sync.Mutex
+	uploads  map[string]*multipartUpload
+	clusters []multipartCluster
+	// Abandoned is called for every backend upload which expired, but
+	// can't be aborted
+	Abandoned func(MultipartAbortFailure)
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// NewMultipartUploads creates directory if needed and loads uploads. Uploads
+// older than ttl are aborted once started, zero ttl keeps uploads until
+// they are completed or aborted by client.
+func NewMultipartUploads(dir string, ttl time.Duration) (*MultipartUploads, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("multipart uploads directory not set")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	mu := &MultipartUploads{
+		dir:     dir,
+		ttl:     ttl,
+		uploads: make(map[string]*multipartUpload),
+		stop:    make(chan struct{}),
+	}
+	return mu, mu.load()
+}
+
+func (mu *MultipartUploads) load() error {
+	paths, err := filepath.Glob(filepath.Join(mu.dir, "*"+multipartUploadSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		upload := &multipartUpload{}
+		if err := json.Unmarshal(content, upload); err != nil {
+			return fmt.Errorf("cannot parse multipart upload %s: %s", path, err)
+		}
+		if err := mu.loadParts(upload); err != nil {
+			return err
+		}
+		mu.uploads[upload.ID] = upload
+	}
+	metrics.UpdateGauge("reqs.multipart.uploads", int64(len(mu.uploads)))
+	return nil
+}
+
+// loadParts applies part ETags appended to upload parts file, records of
+// backends which already finished upload are skipped
+func (mu *MultipartUploads) loadParts(upload *multipartUpload) error {
+	content, err := ioutil.ReadFile(mu.partsPath(upload.ID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		record := partRecord{}
+		if err := json.Unmarshal(line, &record); err != nil {
+			// write of last record may be interrupted
+			log.Printf("Skipping malformed part record of multipart upload %s: %s", upload.ID, err)
+			continue
+		}
+		if _, ok := upload.UploadIDs[record.Host]; !ok {
+			continue
+		}
+		if upload.ETags[record.Host] == nil {
+			upload.ETags[record.Host] = make(map[int]string)
+		}
+		upload.ETags[record.Host][record.PartNumber] = record.ETag
+	}
+	return nil
+}
+
+func (mu *MultipartUploads) uploadPath(id string) string {
+	return filepath.Join(mu.dir, id+multipartUploadSuffix)
+}
+
+func (mu *MultipartUploads) partsPath(id string) string {
+	return filepath.Join(mu.dir, id+multipartPartsSuffix)
+}
+
+// persist writes upload atomically and durably, must be called with
+// upload mx locked
+func (mu *MultipartUploads) persist(upload *multipartUpload) error {
+	content, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(mu.uploadPath(upload.ID), content)
+}
+
+// appendPart appends part record to upload parts file, must be called with
+// upload mx locked
+func (mu *MultipartUploads) appendPart(upload *multipartUpload, record partRecord) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(mu.partsPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(content, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// get returns upload with given id
+func (mu *MultipartUploads) get(id string) (*multipartUpload, bool) {
+	mu.mx.Lock()
+	defer mu.mx.Unlock()
+	upload, ok := mu.uploads[id]
+	return upload, ok
+}
+
+// ForCluster registers cluster transport, it's used to abort expired
+// uploads of its backends. Signed uploads are aborted only by clusters
+// which sign requests with own credentials, signature of client expires.
+func (mu *MultipartUploads) ForCluster(mt *MultiTransport, signed bool) {
+	mu.mx.Lock()
+	defer mu.mx.Unlock()
+	mu.clusters = append(mu.clusters, multipartCluster{transport: mt, signed: signed})
+}
+
+// Start aborts expired uploads in background, if ttl is set
+func (mu *MultipartUploads) Start() {
+	if mu.ttl <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(multipartExpiryInterval)
+		defer ticker.Stop()
+		for {
+			mu.abortExpired()
+			select {
+			case <-ticker.C:
+			case <-mu.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates expired uploads checks
+func (mu *MultipartUploads) Stop() {
+	mu.stopOnce.Do(func() { close(mu.stop) })
+}
+
+// abortExpired sends abort of uploads older than ttl to their backends.
+// Uploads which can't be aborted, as their backends are not part of any
+// cluster or cluster can't sign abort, are reported and forgotten.
+func (mu *MultipartUploads) abortExpired() {
+	mu.mx.Lock()
+	expired := []*multipartUpload{}
+	for _, upload := range mu.uploads {
+		if time.Since(upload.Created) > mu.ttl {
+			expired = append(expired, upload)
+		}
+	}
+	clusters := append([]multipartCluster(nil), mu.clusters...)
+	mu.mx.Unlock()
+	for _, upload := range expired {
+		uploadIDs, ok := mu.backendUploadIDs(upload.ID)
+		if !ok {
+			continue
+		}
+		cluster, ok := clusterOfUpload(clusters, uploadIDs)
+		switch {
+		case !ok:
+			mu.abandon(upload, uploadIDs, "backends are not configured")
+			continue
+		case upload.Authorization != "" && !cluster.signed:
+			mu.abandon(upload, uploadIDs, "cluster has no credentials to sign abort")
+			continue
+		}
+		log.Printf("Aborting expired multipart upload %s of %s", upload.ID, upload.Path)
+		metrics.Mark("reqs.multipart.expired")
+		if err := cluster.transport.abortUpload(upload); err != nil {
+			log.Printf("Could not abort expired multipart upload %s: %s", upload.ID, err)
+		}
+	}
+}
+
+// abandon reports backend uploads of expired upload and forgets it
+func (mu *MultipartUploads) abandon(upload *multipartUpload, uploadIDs map[string]string, reason string) {
+	log.Printf("Forgetting expired multipart upload %s of %s, it can't be aborted: %s", upload.ID, upload.Path, reason)
+	metrics.Mark("reqs.multipart.abandoned")
+	if mu.Abandoned != nil {
+		for host, uploadID := range uploadIDs {
+			mu.Abandoned(MultipartAbortFailure{Host: host, Path: upload.Path, UploadID: uploadID, Error: reason})
+		}
+	}
+	mu.finish(upload.ID)
+}
+
+// clusterOfUpload returns cluster with all upload backends
+func clusterOfUpload(clusters []multipartCluster, uploadIDs map[string]string) (multipartCluster, bool) {
+	for _, cluster := range clusters {
+		found := 0
+		for _, backend := range cluster.transport.Backends {
+			if _, ok := uploadIDs[backend.Host]; ok {
+				found++
+			}
+		}
+		if found == len(uploadIDs) {
+			return cluster, true
+		}
+	}
+	return multipartCluster{}, false
+}
+
+func (mu *MultipartUploads) create(path, authorization string, uploadIDs map[string]string) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	upload := &multipartUpload{
+		ID:            hex.EncodeToString(random),
+		Path:          path,
+		Created:       time.Now(),
+		UploadIDs:     uploadIDs,
+		ETags:         make(map[string]map[int]string),
+		Authorization: authorization,
+	}
+	// parts file is created before upload, so it's made durable by
+	// directory sync of persist
+	parts, err := os.OpenFile(mu.partsPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := parts.Close(); err != nil {
+		return "", err
+	}
+	if err := mu.persist(upload); err != nil {
+		_ = os.Remove(mu.partsPath(upload.ID))
+		return "", err
+	}
+	mu.mx.Lock()
+	defer mu.mx.Unlock()
+	mu.uploads[upload.ID] = upload
+	metrics.UpdateGauge("reqs.multipart.uploads", int64(len(mu.uploads)))
+	return upload.ID, nil
+}
+
+// backendUploadIDs returns copy of upload backend ids
+func (mu *MultipartUploads) backendUploadIDs(id string) (map[string]string, bool) {
+	upload, ok := mu.get(id)
+	if !ok {
+		return nil, false
+	}
+	upload.mx.Lock()
+	defer upload.mx.Unlock()
+	if upload.removed {
+		return nil, false
+	}
+	uploadIDs := make(map[string]string, len(upload.UploadIDs))
+	for host, uploadID := range upload.UploadIDs {
+		uploadIDs[host] = uploadID
+	}
+	return uploadIDs, true
+}
+
+func (mu *MultipartUploads) partETag(id, host string, partNumber int) (string, bool) {
+	upload, ok := mu.get(id)
+	if !ok {
+		return "", false
+	}
+	upload.mx.Lock()
+	defer upload.mx.Unlock()
+	etag, ok := upload.ETags[host][partNumber]
+	return etag, ok
+}
+
+func (mu *MultipartUploads) setPartETag(id, host string, partNumber int, etag string) error {
+	upload, ok := mu.get(id)
+	if !ok {
+		return nil
+	}
+	upload.mx.Lock()
+	defer upload.mx.Unlock()
+	if upload.removed {
+		return nil
+	}
+	if err := mu.appendPart(upload, partRecord{Host: host, PartNumber: partNumber, ETag: etag}); err != nil {
+		return err
+	}
+	if upload.ETags[host] == nil {
+		upload.ETags[host] = make(map[int]string)
+	}
+	upload.ETags[host][partNumber] = etag
+	return nil
+}
+
+// remove forgets upload, must be called with upload mx locked
+func (mu *MultipartUploads) remove(upload *multipartUpload) {
+	upload.removed = true
+	mu.mx.Lock()
+	delete(mu.uploads, upload.ID)
+	metrics.UpdateGauge("reqs.multipart.uploads", int64(len(mu.uploads)))
+	mu.mx.Unlock()
+	for _, path := range []string{mu.uploadPath(upload.ID), mu.partsPath(upload.ID)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove multipart upload file %s: %s", path, err)
+		}
+	}
+}
+
+func (mu *MultipartUploads) finish(id string) {
+	upload, ok := mu.get(id)
+	if !ok {
+		return
+	}
+	upload.mx.Lock()
+	defer upload.mx.Unlock()
+	if !upload.removed {
+		mu.remove(upload)
+	}
+}
+
+// finished forgets backends which completed or aborted upload, upload is
+// forgotten once all its backends are done. Remaining backends get client
+// retries.
+func (mu *MultipartUploads) finished(id string, hosts map[string]bool) {
+	upload, ok := mu.get(id)
+	if !ok || len(hosts) == 0 {
+		return
+	}
+	upload.mx.Lock()
+	defer upload.mx.Unlock()
+	if upload.removed {
+		return
+	}
+	for host := range hosts {
+		delete(upload.UploadIDs, host)
+		delete(upload.ETags, host)
+	}
+	if len(upload.UploadIDs) == 0 {
+		mu.remove(upload)
+		return
+	}
+	log.Printf("Multipart upload %s of %s is not finished on %d backends", id, upload.Path, len(upload.UploadIDs))
+	if err := mu.persist(upload); err != nil {
+		log.Printf("Could not store multipart upload %s: %s", id, err)
+	}
+}
+
+// isMultipartRequest reports if request initiates upload or refers to one
+func isMultipartRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	if _, ok := query["uploads"]; ok && req.Method == http.MethodPost {
+		return true
+	}
+	return query.Get("uploadId") != ""
+}
+
+// multipartRoundTrip sends initiate requests to all backends and other
+// multipart requests to backends which initiated upload. Uploads unknown to
+// coordinator are passed unchanged.
+func (mt *MultiTransport) multipartRoundTrip(req *http.Request) (*http.Response, error) {
+	direct := *mt
+	direct.Multipart = nil
+	query := req.URL.Query()
+	if _, ok := query["uploads"]; ok && req.Method == http.MethodPost {
+		direct.HandleResponses = mt.Multipart.initiated(req, mt.HandleResponses)
+		return direct.RoundTrip(req)
+	}
+
+	id := query.Get("uploadId")
+	uploadIDs, ok := mt.Multipart.backendUploadIDs(id)
+	backends := make([]url.URL, 0, len(mt.Backends))
+	for _, backend := range mt.Backends {
+		if _, initiated := uploadIDs[backend.Host]; initiated {
+			backends = append(backends, backend)
+		}
+	}
+	if !ok || len(backends) == 0 {
+		return direct.RoundTrip(req)
+	}
+	direct.Backends = backends
+	direct.ReadPolicy = nil
+	direct.Hedging = nil
+	direct.PreProcessRequest = ChainProcessors(rewriteUploadID(uploadIDs), mt.PreProcessRequest)
+	direct.HandleResponses = mt.Multipart.observe(id, req, uploadIDs, mt.HandleResponses)
+	if req.Method == http.MethodPost {
+		return direct.completeUpload(req, mt.Multipart, id)
+	}
+	return direct.RoundTrip(req)
+}
+
+// rewriteUploadID returns RequestProcessor replacing client upload id with
+// backend upload id
+func rewriteUploadID(uploadIDs map[string]string) RequestProcessor {
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			query := r.URL.Query()
+			query.Set("uploadId", uploadIDs[r.URL.Host])
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+// initiated returns handler which maps backend upload ids, returned by all
+// backends, to new upload id and replaces them in responses
+func (mu *MultipartUploads) initiated(req *http.Request, handle MultipleResponsesHandler) MultipleResponsesHandler {
+	path := req.URL.Path
+	authorization := req.Header.Get("Authorization")
+	return func(in <-chan ReqResErrTuple) ReqResErrTuple {
+		tups := []ReqResErrTuple{}
+		uploadIDs := make(map[string]string)
+		for tup := range in {
+			if !tup.Failed {
+				result := initiateMultipartUploadResult{}
+				if err := decodeResponseXML(tup.Res, &result); err != nil || result.UploadID == "" {
+					log.Printf("Could not read upload id of %s from %s: %v", path, tup.Req.URL.Host, err)
+					tup.Failed = true
+				} else {
+					uploadIDs[tup.Req.URL.Host] = result.UploadID
+				}
+			}
+			tups = append(tups, tup)
+		}
+		if len(uploadIDs) > 0 {
+			id, err := mu.create(path, authorization, uploadIDs)
+			for i, tup := range tups {
+				backendID, initiated := uploadIDs[tup.Req.URL.Host]
+				if tup.Failed || !initiated {
+					continue
+				}
+				if err != nil {
+					log.Printf("Could not store multipart upload of %s: %s", path, err)
+					discardResponse(tup.Res)
+					tups[i] = ReqResErrTuple{Req: tup.Req, Err: err, Failed: true}
+					continue
+				}
+				rewriteResponseUploadID(tup.Res, backendID, id)
+			}
+		}
+		out := make(chan ReqResErrTuple, len(tups))
+		for _, tup := range tups {
+			out <- tup
+		}
+		close(out)
+		return handle(out)
+	}
+}
+
+type copyPartResult struct {
+	ETag string `xml:"ETag"`
+}
+
+// observe returns handler which records part ETags of backends, replaces
+// backend upload ids in listed parts and forgets backends which completed
+// or aborted upload. Backend responding 404 no longer has the upload.
+func (mu *MultipartUploads) observe(id string, req *http.Request, uploadIDs map[string]string, handle MultipleResponsesHandler) MultipleResponsesHandler {
+	partNumber, _ := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	finishing := req.Method == http.MethodPost || req.Method == http.MethodDelete
+	return func(in <-chan ReqResErrTuple) ReqResErrTuple {
+		out := make(chan ReqResErrTuple, cap(in))
+		go func() {
+			defer close(out)
+			done := make(map[string]bool)
+			for tup := range in {
+				succeeded := !tup.Failed && tup.Err == nil && tup.Res != nil && tup.Res.StatusCode < http.StatusMultipleChoices
+				if succeeded {
+					mu.onSuccess(id, req.Method, partNumber, uploadIDs, tup)
+				}
+				if succeeded || tup.Err == nil && tup.Res != nil && tup.Res.StatusCode == http.StatusNotFound {
+					done[tup.Req.URL.Host] = true
+				}
+				out <- tup
+			}
+			if finishing {
+				mu.finished(id, done)
+			}
+		}()
+		return handle(out)
+	}
+}
+
+func (mu *MultipartUploads) onSuccess(id, method string, partNumber int, uploadIDs map[string]string, tup ReqResErrTuple) {
+	host := tup.Req.URL.Host
+	switch {
+	case method == http.MethodPut && partNumber > 0:
+		etag := tup.Res.Header.Get("ETag")
+		if etag == "" {
+			// UploadPartCopy returns ETag in body
+			result := copyPartResult{}
+			if err := decodeResponseXML(tup.Res, &result); err != nil {
+				log.Debugf("Could not read copied part ETag from %s: %s", host, err)
+			}
+			etag = result.ETag
+		}
+		if etag == "" {
+			return
+		}
+		if err := mu.setPartETag(id, host, partNumber, etag); err != nil {
+			log.Printf("Could not store part %d ETag of multipart upload %s: %s", partNumber, id, err)
+		}
+	case method == http.MethodGet:
+		rewriteResponseUploadID(tup.Res, uploadIDs[host], id)
+	}
+}
+
+type completedPart struct {
+	PartNumber     int
+	ETag           string
+	ChecksumCRC32  string `xml:",omitempty"`
+	ChecksumCRC32C string `xml:",omitempty"`
+	ChecksumSHA1   string `xml:",omitempty"`
+	ChecksumSHA256 string `xml:",omitempty"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Xmlns   string          `xml:"xmlns,attr,omitempty"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// completeUpload sends complete request to backends, parts ETags in body
+// are replaced with ETags returned by each backend
+func (mt *MultiTransport) completeUpload(req *http.Request, mu *MultipartUploads, id string) (*http.Response, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(clientBodyReader(req), maxMultipartXMLSize))
+	if err != nil {
+		return nil, err
+	}
+	complete := completeMultipartUpload{}
+	if err := xml.Unmarshal(body, &complete); err != nil {
+		return nil, fmt.Errorf("malformed complete multipart upload request: %s", err)
+	}
+	reqs := make([]*http.Request, 0, len(mt.Backends))
+	for _, backend := range mt.Backends {
+		backendComplete := completeMultipartUpload{Xmlns: s3XMLNamespace, Parts: make([]completedPart, len(complete.Parts))}
+		for i, part := range complete.Parts {
+			if etag, ok := mu.partETag(id, backend.Host, part.PartNumber); ok {
+				part.ETag = etag
+			}
+			backendComplete.Parts[i] = part
+		}
+		backendBody, err := xml.Marshal(backendComplete)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newBackendRequest(req, backend, bytes.NewReader(backendBody), int64(len(backendBody)))
+		if err != nil {
+			return nil, err
+		}
+		// body differs from client one, so do its checksums
+		r.Header.Del("Content-MD5")
+		if r.Header.Get("X-Amz-Content-Sha256") != "" {
+			hash := sha256.Sum256(backendBody)
+			r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+		}
+		reqs = append(reqs, r)
+	}
+	mt.preProcess(req, reqs...)
+	return mt.sendAll(reqs, backendContext(context.Background(), req), func() {}, mt.HandleResponses)
+}
+
+// abortUpload sends abort of upload coordinated by akubra to its backends,
+// as if client aborted it
+func (mt *MultiTransport) abortUpload(upload *multipartUpload) error {
+	abortURL := url.URL{Path: upload.Path, RawQuery: url.Values{"uploadId": {upload.ID}}.Encode()}
+	req, err := http.NewRequest(http.MethodDelete, abortURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if upload.Authorization != "" {
+		// expired client signature marks signature version only, it's
+		// replaced by cluster signer
+		req.Header.Set("Authorization", upload.Authorization)
+	}
+	ctx := context.WithValue(context.Background(), log.ContextreqIDKey, "multipart-expiry-"+upload.ID)
+	resp, err := mt.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	discardResponse(resp)
+	return nil
+}
+
+// decodeResponseXML reads response body into v, body is restored so it
+// can be read again
+func decodeResponseXML(resp *http.Response, v interface{}) error {
+	body, err := readResponseBody(resp)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(body, v)
+}
+
+func readResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil {
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMultipartXMLSize))
+	if closeErr := resp.Body.Close(); err == nil {
+		err = closeErr
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// rewriteResponseUploadID replaces backend upload id in response body
+func rewriteResponseUploadID(resp *http.Response, backendID, id string) {
+	body, err := readResponseBody(resp)
+	if err != nil {
+		log.Debugf("Could not read multipart response body: %s", err)
+		return
+	}
+	body = bytes.Replace(body, []byte("<UploadId>"+backendID+"</UploadId>"), []byte("<UploadId>"+id+"</UploadId>"), -1)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Transfer-Encoding")
+}
@@ -0,0 +1,390 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMultipartBackends emulates multipart API of backends, every backend
+// issues its own upload id and part ETags, failing backends respond 500
+type fakeMultipartBackends struct {
+	mx       sync.Mutex
+	requests map[string][]*http.Request
+	bodies   map[string][]string
+	failing  map[string]bool
+}
+
+func (fmb *fakeMultipartBackends) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(content)
+	}
+	fmb.mx.Lock()
+	fmb.requests[req.URL.Host] = append(fmb.requests[req.URL.Host], req)
+	fmb.bodies[req.URL.Host] = append(fmb.bodies[req.URL.Host], body)
+	failing := fmb.failing[req.URL.Host]
+	fmb.mx.Unlock()
+
+	host := req.URL.Host
+	query := req.URL.Query()
+	resp := &http.Response{StatusCode: http.StatusOK, Header: make(http.Header), Body: http.NoBody, Request: req}
+	switch {
+	case failing:
+		resp.StatusCode = http.StatusInternalServerError
+	case req.Method == http.MethodPost && query.Get("uploadId") == "":
+		resp.Body = ioutil.NopCloser(strings.NewReader(
+			fmt.Sprintf("<InitiateMultipartUploadResult><UploadId>%s-upload</UploadId></InitiateMultipartUploadResult>", host)))
+	case req.Method == http.MethodPut:
+		resp.Header.Set("ETag", fmt.Sprintf(`"%s-part-%s"`, host, query.Get("partNumber")))
+	case req.Method == http.MethodDelete:
+		resp.StatusCode = http.StatusNoContent
+	}
+	return resp, nil
+}
+
+func (fmb *fakeMultipartBackends) setFailing(host string, failing bool) {
+	fmb.mx.Lock()
+	defer fmb.mx.Unlock()
+	fmb.failing[host] = failing
+}
+
+func (fmb *fakeMultipartBackends) requestsCount(host string) int {
+	fmb.mx.Lock()
+	defer fmb.mx.Unlock()
+	return len(fmb.requests[host])
+}
+
+func (fmb *fakeMultipartBackends) lastRequest(host string) (*http.Request, string) {
+	fmb.mx.Lock()
+	defer fmb.mx.Unlock()
+	reqs := fmb.requests[host]
+	if len(reqs) == 0 {
+		return nil, ""
+	}
+	return reqs[len(reqs)-1], fmb.bodies[host][len(reqs)-1]
+}
+
+func mkMultipartTransport(t *testing.T, dir string) (*MultiTransport, *fakeMultipartBackends) {
+	backends := &fakeMultipartBackends{
+		requests: make(map[string][]*http.Request),
+		bodies:   make(map[string][]string),
+		failing:  make(map[string]bool),
+	}
+	multipart, err := NewMultipartUploads(dir, 0)
+	require.NoError(t, err)
+	transp := &MultiTransport{
+		RoundTripper: backends,
+		Backends:     mkBackends("a", "b"),
+		Multipart:    multipart,
+		HandleResponses: func(in <-chan ReqResErrTuple) ReqResErrTuple {
+			var first *ReqResErrTuple
+			for tup := range in {
+				if first == nil && !tup.Failed {
+					tup := tup
+					first = &tup
+					continue
+				}
+				discardResponse(tup.Res)
+			}
+			require.NotNil(t, first)
+			return *first
+		},
+	}
+	return transp, backends
+}
+
+func mkMultipartRequest(t *testing.T, method, query, body string) *http.Request {
+	req, err := http.NewRequest(method, "http://akubra/bucket/object?"+query, strings.NewReader(body))
+	require.NoError(t, err)
+	return req
+}
+
+func initiateUpload(t *testing.T, transp *MultiTransport) string {
+	resp, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodPost, "uploads", ""))
+	require.NoError(t, err)
+	result := initiateMultipartUploadResult{}
+	require.NoError(t, decodeResponseXML(resp, &result))
+	require.NotEmpty(t, result.UploadID)
+	return result.UploadID
+}
+
+func TestMultipartInitiateIssuesOwnUploadID(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, _ := mkMultipartTransport(t, dir)
+
+	id := initiateUpload(t, transp)
+
+	assert.NotEqual(t, "a-upload", id)
+	assert.NotEqual(t, "b-upload", id)
+	uploadIDs, ok := transp.Multipart.backendUploadIDs(id)
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"a": "a-upload", "b": "b-upload"}, uploadIDs)
+
+	reloaded, err := NewMultipartUploads(dir, 0)
+	require.NoError(t, err)
+	uploadIDs, ok = reloaded.backendUploadIDs(id)
+	require.True(t, ok, "upload should survive restart")
+	assert.Equal(t, map[string]string{"a": "a-upload", "b": "b-upload"}, uploadIDs)
+}
+
+func TestMultipartPartUploadUsesBackendUploadIDs(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+
+	_, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodPut, "partNumber=1&uploadId="+id, "part"))
+	require.NoError(t, err)
+
+	for _, host := range []string{"a", "b"} {
+		req, body := backends.lastRequest(host)
+		require.NotNil(t, req)
+		assert.Equal(t, host+"-upload", req.URL.Query().Get("uploadId"))
+		assert.Equal(t, "part", body)
+		etag, ok := transp.Multipart.partETag(id, host, 1)
+		require.True(t, ok)
+		assert.Equal(t, fmt.Sprintf(`"%s-part-1"`, host), etag)
+	}
+}
+
+func TestMultipartPartETagsAreAppendedAndSurviveRestart(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, _ := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+	stored, err := ioutil.ReadFile(transp.Multipart.uploadPath(id))
+	require.NoError(t, err)
+
+	for _, partNumber := range []string{"1", "2"} {
+		_, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodPut, "partNumber="+partNumber+"&uploadId="+id, "part"))
+		require.NoError(t, err)
+	}
+	// interrupted append
+	parts, err := os.OpenFile(transp.Multipart.partsPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = parts.WriteString(`{"Host":"a","PartNu`)
+	require.NoError(t, err)
+	require.NoError(t, parts.Close())
+
+	unchanged, err := ioutil.ReadFile(transp.Multipart.uploadPath(id))
+	require.NoError(t, err)
+	assert.Equal(t, string(stored), string(unchanged), "upload shouldn't be rewritten for every part")
+	reloaded, err := NewMultipartUploads(dir, 0)
+	require.NoError(t, err)
+	for _, host := range []string{"a", "b"} {
+		for _, partNumber := range []int{1, 2} {
+			etag, ok := reloaded.partETag(id, host, partNumber)
+			require.True(t, ok, "%s part %d", host, partNumber)
+			assert.Equal(t, fmt.Sprintf(`"%s-part-%d"`, host, partNumber), etag)
+		}
+	}
+}
+
+func TestMultipartCompleteSendsBackendETags(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+	_, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodPut, "partNumber=1&uploadId="+id, "part"))
+	require.NoError(t, err)
+
+	complete := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"client-etag"</ETag></Part></CompleteMultipartUpload>`
+	_, err = transp.RoundTrip(mkMultipartRequest(t, http.MethodPost, "uploadId="+id, complete))
+	require.NoError(t, err)
+
+	for _, host := range []string{"a", "b"} {
+		req, body := backends.lastRequest(host)
+		require.NotNil(t, req)
+		assert.Equal(t, host+"-upload", req.URL.Query().Get("uploadId"))
+		assert.Contains(t, body, fmt.Sprintf("<ETag>&#34;%s-part-1&#34;</ETag>", host))
+		assert.NotContains(t, body, "client-etag")
+	}
+	_, ok := transp.Multipart.backendUploadIDs(id)
+	assert.False(t, ok, "completed upload should be forgotten")
+	reloaded, err := NewMultipartUploads(dir, 0)
+	require.NoError(t, err)
+	_, ok = reloaded.backendUploadIDs(id)
+	assert.False(t, ok, "completed upload should be removed from disk")
+}
+
+func TestMultipartCompleteReplacesClientBodyChecksums(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+
+	complete := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>"client-etag"</ETag></Part></CompleteMultipartUpload>`
+	clientHash := sha256.Sum256([]byte(complete))
+	req := mkMultipartRequest(t, http.MethodPost, "uploadId="+id, complete)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(clientHash[:]))
+	req.Header.Set("Content-MD5", "client-md5")
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+
+	for _, host := range []string{"a", "b"} {
+		backendReq, body := backends.lastRequest(host)
+		require.NotNil(t, backendReq)
+		hash := sha256.Sum256([]byte(body))
+		assert.Equal(t, hex.EncodeToString(hash[:]), backendReq.Header.Get("X-Amz-Content-Sha256"))
+		assert.Empty(t, backendReq.Header.Get("Content-MD5"))
+		assert.Equal(t, int64(len(body)), backendReq.ContentLength)
+	}
+}
+
+func TestMultipartAbortIsSentToInitiatedBackendsOnly(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+	transp.Backends = mkBackends("a", "b", "c")
+
+	_, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodDelete, "uploadId="+id, ""))
+	require.NoError(t, err)
+
+	req, _ := backends.lastRequest("a")
+	assert.Equal(t, http.MethodDelete, req.Method)
+	assert.Equal(t, "a-upload", req.URL.Query().Get("uploadId"))
+	req, _ = backends.lastRequest("c")
+	assert.Nil(t, req, "backend without upload shouldn't be called")
+	_, ok := transp.Multipart.backendUploadIDs(id)
+	assert.False(t, ok, "aborted upload should be forgotten")
+}
+
+func TestMultipartUnknownUploadIDIsPassedThrough(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+
+	_, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodPut, "partNumber=1&uploadId=unknown", "part"))
+	require.NoError(t, err)
+
+	for _, host := range []string{"a", "b"} {
+		req, _ := backends.lastRequest(host)
+		require.NotNil(t, req)
+		assert.Equal(t, "unknown", req.URL.Query().Get("uploadId"))
+	}
+}
+
+func TestMultipartAbortFailedOnBackendIsKeptForRetry(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+	backends.setFailing("b", true)
+
+	_, err := transp.RoundTrip(mkMultipartRequest(t, http.MethodDelete, "uploadId="+id, ""))
+	require.NoError(t, err)
+
+	uploadIDs, ok := transp.Multipart.backendUploadIDs(id)
+	require.True(t, ok, "upload not aborted on all backends should be kept")
+	assert.Equal(t, map[string]string{"b": "b-upload"}, uploadIDs)
+
+	backends.setFailing("b", false)
+	aRequests := backends.requestsCount("a")
+	_, err = transp.RoundTrip(mkMultipartRequest(t, http.MethodDelete, "uploadId="+id, ""))
+	require.NoError(t, err)
+
+	assert.Equal(t, aRequests, backends.requestsCount("a"), "retry should be sent only to failed backend")
+	req, _ := backends.lastRequest("b")
+	assert.Equal(t, "b-upload", req.URL.Query().Get("uploadId"))
+	_, ok = transp.Multipart.backendUploadIDs(id)
+	assert.False(t, ok)
+}
+
+func TestExpiredMultipartUploadsAreAbortedOnBackends(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	transp, backends := mkMultipartTransport(t, dir)
+	id := initiateUpload(t, transp)
+
+	reloaded, err := NewMultipartUploads(dir, time.Nanosecond)
+	require.NoError(t, err)
+	transp.Multipart = reloaded
+	reloaded.ForCluster(transp, false)
+	reloaded.abortExpired()
+
+	for _, host := range []string{"a", "b"} {
+		req, _ := backends.lastRequest(host)
+		require.NotNil(t, req)
+		assert.Equal(t, http.MethodDelete, req.Method)
+		assert.Equal(t, host+"-upload", req.URL.Query().Get("uploadId"))
+	}
+	_, ok := reloaded.backendUploadIDs(id)
+	assert.False(t, ok)
+	_, err = os.Stat(reloaded.uploadPath(id))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExpiredMultipartUploadsOfUnknownBackendsAreForgotten(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	multipart, err := NewMultipartUploads(dir, 0)
+	require.NoError(t, err)
+	id, err := multipart.create("/bucket/object", "", map[string]string{"a": "a-upload"})
+	require.NoError(t, err)
+
+	reloaded, err := NewMultipartUploads(dir, time.Nanosecond)
+	require.NoError(t, err)
+	_, ok := reloaded.backendUploadIDs(id)
+	require.True(t, ok, "expired upload should be kept until it's aborted")
+	reloaded.abortExpired()
+
+	_, ok = reloaded.backendUploadIDs(id)
+	assert.False(t, ok)
+	_, err = os.Stat(reloaded.uploadPath(id))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestExpiredSignedMultipartUploadsAreAbortedByClusterWithCredentials(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, signed := range []bool{true, false} {
+		transp, backends := mkMultipartTransport(t, dir)
+		initiate := mkMultipartRequest(t, http.MethodPost, "uploads", "")
+		initiate.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=client/20130524/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=abc")
+		resp, err := transp.RoundTrip(initiate)
+		require.NoError(t, err)
+		result := initiateMultipartUploadResult{}
+		require.NoError(t, decodeResponseXML(resp, &result))
+
+		reloaded, err := NewMultipartUploads(dir, time.Nanosecond)
+		require.NoError(t, err)
+		abandoned := []MultipartAbortFailure{}
+		reloaded.Abandoned = func(failure MultipartAbortFailure) { abandoned = append(abandoned, failure) }
+		transp.Multipart = reloaded
+		reloaded.ForCluster(transp, signed)
+		reloaded.abortExpired()
+
+		_, ok := reloaded.backendUploadIDs(result.UploadID)
+		assert.False(t, ok, "signed: %t", signed)
+		req, _ := backends.lastRequest("a")
+		if signed {
+			assert.Equal(t, http.MethodDelete, req.Method)
+			assert.NotEmpty(t, req.Header.Get("Authorization"), "cluster signer gets signed abort")
+			assert.Empty(t, abandoned)
+			continue
+		}
+		assert.Equal(t, http.MethodPost, req.Method, "abort with expired client signature shouldn't be sent")
+		require.Len(t, abandoned, 2)
+		for _, failure := range abandoned {
+			assert.Equal(t, "/bucket/object", failure.Path)
+			assert.Equal(t, failure.Host+"-upload", failure.UploadID)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+)
+
+const (
+	// SetHeadersProcessor sets headers of backend requests
+	SetHeadersProcessor = "set-headers"
+	// RemoveHeadersProcessor removes headers from backend requests
+	RemoveHeadersProcessor = "remove-headers"
+	// RewritePathPrefixProcessor replaces path prefix of backend requests
+	RewritePathPrefixProcessor = "rewrite-path-prefix"
+	// StripQueryParamsProcessor removes query parameters from backend requests
+	StripQueryParamsProcessor = "strip-query-params"
+)
+
+// SetHeaders returns RequestProcessor setting headers of copies, Host
+// header changes request Host. Host is kept in headers too, so it's not
+// lost when copy is rebuilt for backend.
+func SetHeaders(headers map[string]string) RequestProcessor {
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			for name, value := range headers {
+				if http.CanonicalHeaderKey(name) == "Host" {
+					r.Host = value
+				}
+				r.Header.Set(name, value)
+			}
+		}
+	}
+}
+
+// RemoveHeaders returns RequestProcessor removing headers from copies
+func RemoveHeaders(names []string) RequestProcessor {
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			for _, name := range names {
+				r.Header.Del(name)
+			}
+		}
+	}
+}
+
+// RewritePathPrefix returns RequestProcessor replacing from path prefix
+// with to, copies with other paths are not changed
+func RewritePathPrefix(from, to string) RequestProcessor {
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			if !strings.HasPrefix(r.URL.Path, from) {
+				continue
+			}
+			r.URL.Path = to + strings.TrimPrefix(r.URL.Path, from)
+			r.URL.RawPath = ""
+		}
+	}
+}
+
+// StripQueryParams returns RequestProcessor removing query parameters from
+// copies, query is not reencoded if none of parameters is present
+func StripQueryParams(names []string) RequestProcessor {
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			query := r.URL.Query()
+			stripped := false
+			for _, name := range names {
+				if _, ok := query[name]; ok {
+					query.Del(name)
+					stripped = true
+				}
+			}
+			if stripped {
+				r.URL.RawQuery = query.Encode()
+			}
+		}
+	}
+}
+
+// ChainProcessors returns RequestProcessor running processors in order,
+// nil processors are skipped. Returns nil if there is nothing to run.
+func ChainProcessors(processors ...RequestProcessor) RequestProcessor {
+	chain := make([]RequestProcessor, 0, len(processors))
+	for _, processor := range processors {
+		if processor != nil {
+			chain = append(chain, processor)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	}
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, processor := range chain {
+			processor(orig, copies)
+		}
+	}
+}
+
+// HostProcessors returns RequestProcessor running processor selected by
+// copy URL host, copies to other hosts are not changed. Returns nil if
+// hosts is empty.
+func HostProcessors(hosts map[string]RequestProcessor) RequestProcessor {
+	if len(hosts) == 0 {
+		return nil
+	}
+	return func(orig *http.Request, copies []*http.Request) {
+		for _, r := range copies {
+			if processor, ok := hosts[r.URL.Host]; ok {
+				processor(orig, []*http.Request{r})
+			}
+		}
+	}
+}
+
+// NewRequestProcessor creates processors chain from configuration, returns
+// nil if confs is empty
+func NewRequestProcessor(confs []shardingconfig.RequestProcessorConfig) (RequestProcessor, error) {
+	processors := make([]RequestProcessor, 0, len(confs))
+	for _, conf := range confs {
+		processor, err := newRequestProcessor(conf)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, processor)
+	}
+	return ChainProcessors(processors...), nil
+}
+
+func newRequestProcessor(conf shardingconfig.RequestProcessorConfig) (RequestProcessor, error) {
+	switch conf.Type {
+	case SetHeadersProcessor:
+		if len(conf.Headers) == 0 {
+			return nil, fmt.Errorf("%s processor requires Headers", conf.Type)
+		}
+		return SetHeaders(conf.Headers), nil
+	case RemoveHeadersProcessor:
+		if len(conf.Names) == 0 {
+			return nil, fmt.Errorf("%s processor requires Names", conf.Type)
+		}
+		return RemoveHeaders(conf.Names), nil
+	case RewritePathPrefixProcessor:
+		if conf.From == "" {
+			return nil, fmt.Errorf("%s processor requires From", conf.Type)
+		}
+		return RewritePathPrefix(conf.From, conf.To), nil
+	case StripQueryParamsProcessor:
+		if len(conf.Names) == 0 {
+			return nil, fmt.Errorf("%s processor requires Names", conf.Type)
+		}
+		return StripQueryParams(conf.Names), nil
+	}
+	return nil, fmt.Errorf("unknown request processor %q", conf.Type)
+}
+
+// preProcess runs PreProcessRequest on copies of orig, if it's set
+func (mt *MultiTransport) preProcess(orig *http.Request, copies ...*http.Request) {
+	if mt.PreProcessRequest != nil {
+		mt.PreProcessRequest(orig, copies)
+	}
+}
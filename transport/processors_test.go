@@ -0,0 +1,88 @@
+package transport
+
+import (
+	"net/http"
+	"testing"
+
+	shardingconfig "github.com/allegro/akubra/sharding/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfiguredProcessorsRunInOrder(t *testing.T) {
+	processor, err := NewRequestProcessor([]shardingconfig.RequestProcessorConfig{
+		{Type: SetHeadersProcessor, Headers: map[string]string{"X-Tier": "cold", "Host": "backend.internal"}},
+		{Type: RemoveHeadersProcessor, Names: []string{"X-Forwarded-For", "X-Tier"}},
+		{Type: RewritePathPrefixProcessor, From: "/bucket/", To: "/prefixed-bucket/"},
+		{Type: StripQueryParamsProcessor, Names: []string{"x-id"}},
+	})
+	require.NoError(t, err)
+	orig, _ := http.NewRequest("GET", "http://example.com/bucket/key?x-id=GetObject&versionId=1", nil)
+	orig.Header.Set("X-Forwarded-For", "10.0.0.1")
+	backendReq, _ := http.NewRequest("GET", orig.URL.String(), nil)
+	backendReq.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	processor(orig, []*http.Request{backendReq})
+
+	assert.Equal(t, "backend.internal", backendReq.Host)
+	assert.Empty(t, backendReq.Header.Get("X-Forwarded-For"))
+	assert.Empty(t, backendReq.Header.Get("X-Tier"), "Header set by first processor should be removed by second one")
+	assert.Equal(t, "/prefixed-bucket/key", backendReq.URL.Path)
+	assert.Equal(t, "versionId=1", backendReq.URL.RawQuery)
+	assert.Equal(t, "/bucket/key", orig.URL.Path, "Client request should not be changed")
+}
+
+func TestHostSetOnRequestIsKeptForBackends(t *testing.T) {
+	hosts := make(chan string, 2)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		hosts <- req.Host
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), rt, t)
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", nil)
+	SetHeaders(map[string]string{"Host": "region.internal"})(req, []*http.Request{req})
+
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	close(hosts)
+	sent := 0
+	for host := range hosts {
+		assert.Equal(t, "region.internal", host)
+		sent++
+	}
+	assert.Equal(t, 2, sent)
+}
+
+func TestInvalidProcessorsConfiguration(t *testing.T) {
+	_, err := NewRequestProcessor([]shardingconfig.RequestProcessorConfig{{Type: "unknown"}})
+	assert.Error(t, err)
+	_, err = NewRequestProcessor([]shardingconfig.RequestProcessorConfig{{Type: RewritePathPrefixProcessor}})
+	assert.Error(t, err)
+	processor, err := NewRequestProcessor(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, processor)
+}
+
+func TestMultiTransportProcessesBackendCopies(t *testing.T) {
+	headers := make(chan http.Header, 2)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		headers <- req.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), rt, t)
+	transp.PreProcessRequest = HostProcessors(map[string]RequestProcessor{
+		"b": SetHeaders(map[string]string{"X-Backend": "b"}),
+	})
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", nil)
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	close(headers)
+	values := []string{}
+	for header := range headers {
+		values = append(values, header.Get("X-Backend"))
+	}
+	assert.Len(t, values, 2)
+	assert.Contains(t, values, "b")
+	assert.Contains(t, values, "")
+}
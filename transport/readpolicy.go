@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+)
+
+const (
+	// RoundRobinReadPolicy rotates backends on every read
+	RoundRobinReadPolicy = "round-robin"
+	// LeastLatencyReadPolicy prefers backends with lowest latency moving
+	// average
+	LeastLatencyReadPolicy = "least-latency"
+	// PreferredZoneReadPolicy prefers backends from configured zone
+	PreferredZoneReadPolicy = "preferred-zone"
+)
+
+// ReadPolicy orders backends for single backend reads, first backend
+// is asked first, others are used for failover
+type ReadPolicy interface {
+	Order(backends []url.URL) []url.URL
+}
+
+type roundRobinPolicy struct {
+	counter uint64
+}
+
+func (rr *roundRobinPolicy) Order(backends []url.URL) []url.URL {
+	ordered := make([]url.URL, 0, len(backends))
+	if len(backends) == 0 {
+		return ordered
+	}
+	start := int(atomic.AddUint64(&rr.counter, 1) % uint64(len(backends)))
+	ordered = append(ordered, backends[start:]...)
+	return append(ordered, backends[:start]...)
+}
+
+type leastLatencyPolicy struct {
+	// latency returns backend host latency estimate, zero if unknown
+	latency func(host string) float64
+}
+
+func backendLatency(host string) float64 {
+	return float64(BackendLatency(host))
+}
+
+func (ll *leastLatencyPolicy) Order(backends []url.URL) []url.URL {
+	ordered := make([]url.URL, len(backends))
+	copy(ordered, backends)
+	latencies := make(map[string]float64, len(backends))
+	for _, backend := range backends {
+		latencies[backend.Host] = ll.latency(backend.Host)
+	}
+	// backends without measurements go first, so they get some traffic
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return latencies[ordered[i].Host] < latencies[ordered[j].Host]
+	})
+	return ordered
+}
+
+type preferredZonePolicy struct {
+	zone  string
+	zones map[string]string
+	rr    roundRobinPolicy
+}
+
+func (pz *preferredZonePolicy) Order(backends []url.URL) []url.URL {
+	rotated := pz.rr.Order(backends)
+	preferred := make([]url.URL, 0, len(backends))
+	others := make([]url.URL, 0, len(backends))
+	for _, backend := range rotated {
+		if pz.zones[backend.Host] == pz.zone {
+			preferred = append(preferred, backend)
+		} else {
+			others = append(others, backend)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// NewReadPolicy creates ReadPolicy by name. Empty name means no read
+// policy, requests are sent to all backends. Zones map backend hosts
+// to zone names and are used by preferred-zone policy only.
+func NewReadPolicy(name, preferredZone string, zones map[string]string) (ReadPolicy, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case RoundRobinReadPolicy:
+		return &roundRobinPolicy{}, nil
+	case LeastLatencyReadPolicy:
+		return &leastLatencyPolicy{latency: backendLatency}, nil
+	case PreferredZoneReadPolicy:
+		if preferredZone == "" {
+			return nil, fmt.Errorf("%s read policy requires preferred zone", name)
+		}
+		return &preferredZonePolicy{zone: preferredZone, zones: zones}, nil
+	}
+	return nil, fmt.Errorf("unknown read policy %q", name)
+}
+
+func isSingleBackendRead(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead
+}
+
+// needsFailover reports if read should be repeated on next backend
+func needsFailover(tup ReqResErrTuple) bool {
+	if tup.Err != nil || tup.Res == nil {
+		return true
+	}
+	return tup.Res.StatusCode == http.StatusNotFound || tup.Res.StatusCode >= 500
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkBackends(hosts ...string) []url.URL {
+	backends := make([]url.URL, 0, len(hosts))
+	for _, host := range hosts {
+		backends = append(backends, url.URL{Scheme: "http", Host: host})
+	}
+	return backends
+}
+
+func hostsOf(backends []url.URL) []string {
+	hosts := make([]string, 0, len(backends))
+	for _, backend := range backends {
+		hosts = append(hosts, backend.Host)
+	}
+	return hosts
+}
+
+func TestRoundRobinReadPolicyRotatesBackends(t *testing.T) {
+	policy, err := NewReadPolicy(RoundRobinReadPolicy, "", nil)
+	require.NoError(t, err)
+	backends := mkBackends("a", "b", "c")
+	assert.Equal(t, []string{"b", "c", "a"}, hostsOf(policy.Order(backends)))
+	assert.Equal(t, []string{"c", "a", "b"}, hostsOf(policy.Order(backends)))
+	assert.Equal(t, []string{"a", "b", "c"}, hostsOf(policy.Order(backends)))
+}
+
+func TestLeastLatencyReadPolicyPrefersFastBackends(t *testing.T) {
+	latencies := map[string]float64{"a": 30, "b": 10, "c": 20}
+	policy := &leastLatencyPolicy{latency: func(host string) float64 { return latencies[host] }}
+	assert.Equal(t, []string{"b", "c", "a"}, hostsOf(policy.Order(mkBackends("a", "b", "c"))))
+}
+
+func TestPreferredZoneReadPolicyPrefersZoneBackends(t *testing.T) {
+	zones := map[string]string{"a": "dc1", "b": "dc2", "c": "dc2"}
+	policy, err := NewReadPolicy(PreferredZoneReadPolicy, "dc2", zones)
+	require.NoError(t, err)
+	ordered := hostsOf(policy.Order(mkBackends("a", "b", "c")))
+	assert.Contains(t, ordered[:2], "b")
+	assert.Contains(t, ordered[:2], "c")
+	assert.Equal(t, "a", ordered[2])
+}
+
+func TestUnknownReadPolicy(t *testing.T) {
+	_, err := NewReadPolicy("random", "", nil)
+	assert.Error(t, err)
+}
+
+type recordingRoundTripper struct {
+	mx       sync.Mutex
+	calls    []string
+	statuses map[string]int
+}
+
+func (rrt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rrt.mx.Lock()
+	defer rrt.mx.Unlock()
+	rrt.calls = append(rrt.calls, req.URL.Host)
+	return &http.Response{StatusCode: rrt.statuses[req.URL.Host], Body: http.NoBody, Request: req}, nil
+}
+
+func TestReadWithFailoverStopsOnFirstSuccess(t *testing.T) {
+	rt := &recordingRoundTripper{statuses: map[string]int{"a": 404, "b": 200, "c": 200}}
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b", "c"), rt, t)
+	transp.ReadPolicy = &leastLatencyPolicy{latency: func(host string) float64 { return 0 }}
+	transp.HandleResponses = func(in <-chan ReqResErrTuple) ReqResErrTuple {
+		var last ReqResErrTuple
+		for tup := range in {
+			if !tup.Failed {
+				return tup
+			}
+			last = tup
+		}
+		return last
+	}
+	req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"a", "b"}, rt.calls)
+}
+
+func TestWritesAreReplicatedWithReadPolicy(t *testing.T) {
+	rt := &recordingRoundTripper{statuses: map[string]int{"a": 200, "b": 200, "c": 200}}
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b", "c"), rt, t)
+	transp.ReadPolicy = &roundRobinPolicy{}
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", nil)
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	sort.Strings(rt.calls)
+	assert.Equal(t, []string{"a", "b", "c"}, rt.calls)
+}
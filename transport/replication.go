@@ -0,0 +1,757 @@
+package transport
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	defaultReplicationWorkers       = 4
+	defaultReplicationMaxAttempts   = 10
+	defaultReplicationRetryInterval = 10 * time.Second
+	replicationBodySuffix           = ".body"
+	replicationJobSuffix            = ".json"
+)
+
+// ReplicationQueueConfig defines where and how asynchronous replication
+// jobs are stored and processed
+type ReplicationQueueConfig struct {
+	// Dir keeps queued jobs, jobs found there on start are resumed
+	Dir string
+	// Workers is number of jobs processed in parallel
+	Workers int
+	// MaxAttempts after which job is dropped
+	MaxAttempts int
+	// RetryInterval is wait time between job attempts
+	RetryInterval time.Duration
+}
+
+func (rqc ReplicationQueueConfig) withDefaults() ReplicationQueueConfig {
+	if rqc.Workers <= 0 {
+		rqc.Workers = defaultReplicationWorkers
+	}
+	if rqc.MaxAttempts <= 0 {
+		rqc.MaxAttempts = defaultReplicationMaxAttempts
+	}
+	if rqc.RetryInterval <= 0 {
+		rqc.RetryInterval = defaultReplicationRetryInterval
+	}
+	return rqc
+}
+
+// ReplicationFailure describes write which could not be replicated to
+// backend within MaxAttempts
+type ReplicationFailure struct {
+	Method        string
+	Host          string
+	Path          string
+	SuccessHost   string
+	UserAgent     string
+	ReqID         string
+	Error         string
+	ContentLength int64
+}
+
+// replicationJob is persisted as json next to request body file
+type replicationJob struct {
+	ID            string
+	Cluster       string
+	Method        string
+	RequestURI    string
+	Header        http.Header
+	ContentLength int64
+	ReqID         string
+	SuccessHost   string
+	// Backends are remaining backend urls (scheme://host)
+	Backends    []string
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// objectPath returns path of object written by job
+func (job *replicationJob) objectPath() string {
+	path := job.RequestURI
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// objectKey identifies object written by job in cluster
+func (job *replicationJob) objectKey() string {
+	return job.Cluster + " " + job.objectPath()
+}
+
+// supersedes reports if job overwrites whole object, so older jobs of the
+// same object don't have to be replicated
+func (job *replicationJob) supersedes() bool {
+	return !strings.Contains(job.RequestURI, "?")
+}
+
+// before orders jobs by creation
+func (job *replicationJob) before(other *replicationJob) bool {
+	if job.Created.Equal(other.Created) {
+		return job.ID < other.ID
+	}
+	return job.Created.Before(other.Created)
+}
+
+// ReplicationQueue is durable, on disk queue of writes which have to be
+// repeated on remaining backends. Jobs of the same object are processed one
+// by one, in order they were queued.
+type ReplicationQueue struct {
+	conf ReplicationQueueConfig
+	// Dropped is called for every backend which did not get the write
+	Dropped    func(ReplicationFailure)
+	mx         sync.Mutex
+	clusters   map[string]clusterReplication
+	jobs       map[string]*replicationJob
+	inProgress map[string]bool
+	work       chan replicationJob
+	notify     chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+}
+
+// NewReplicationQueue creates queue directory if needed and loads jobs
+// left by previous process
+func NewReplicationQueue(conf ReplicationQueueConfig) (*ReplicationQueue, error) {
+	conf = conf.withDefaults()
+	if conf.Dir == "" {
+		return nil, fmt.Errorf("replication queue directory not set")
+	}
+	if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+		return nil, err
+	}
+	rq := &ReplicationQueue{
+		conf:       conf,
+		clusters:   make(map[string]clusterReplication),
+		jobs:       make(map[string]*replicationJob),
+		inProgress: make(map[string]bool),
+		work:       make(chan replicationJob),
+		notify:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	return rq, rq.load()
+}
+
+// load reads persisted jobs, bodies of jobs never committed are removed
+func (rq *ReplicationQueue) load() error {
+	bodies, err := filepath.Glob(filepath.Join(rq.conf.Dir, "*"+replicationBodySuffix))
+	if err != nil {
+		return err
+	}
+	for _, bodyPath := range bodies {
+		id := strings.TrimSuffix(filepath.Base(bodyPath), replicationBodySuffix)
+		content, err := ioutil.ReadFile(rq.jobPath(id))
+		if os.IsNotExist(err) {
+			log.Printf("Removing uncommitted replication body %s", bodyPath)
+			if err := os.Remove(bodyPath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		job := &replicationJob{}
+		if err := json.Unmarshal(content, job); err != nil {
+			return fmt.Errorf("cannot parse replication job %s: %s", id, err)
+		}
+		rq.jobs[job.ID] = job
+	}
+	if len(rq.jobs) > 0 {
+		log.Printf("Resuming %d replication jobs", len(rq.jobs))
+	}
+	return nil
+}
+
+func (rq *ReplicationQueue) bodyPath(id string) string {
+	return filepath.Join(rq.conf.Dir, id+replicationBodySuffix)
+}
+
+func (rq *ReplicationQueue) jobPath(id string) string {
+	return filepath.Join(rq.conf.Dir, id+replicationJobSuffix)
+}
+
+// errBackendNotConfigured is reported for jobs of backends removed from
+// configuration
+var errBackendNotConfigured = errors.New("backend is not configured")
+
+// clusterReplication defines how writes are sent to cluster backends
+type clusterReplication struct {
+	// backends are configured backend urls (scheme://host)
+	backends     map[string]bool
+	roundTripper http.RoundTripper
+	process      RequestProcessor
+}
+
+// ForCluster registers cluster backends, round tripper and request
+// processor, which may be nil, used to replicate cluster writes
+func (rq *ReplicationQueue) ForCluster(cluster string, backends []url.URL, roundTripper http.RoundTripper, process RequestProcessor) *AsyncReplication {
+	rq.mx.Lock()
+	defer rq.mx.Unlock()
+	configured := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		configured[backendURL(backend)] = true
+	}
+	rq.clusters[cluster] = clusterReplication{backends: configured, roundTripper: roundTripper, process: process}
+	return &AsyncReplication{queue: rq, cluster: cluster}
+}
+
+// Len returns number of queued jobs
+func (rq *ReplicationQueue) Len() int {
+	rq.mx.Lock()
+	defer rq.mx.Unlock()
+	return len(rq.jobs)
+}
+
+// Start runs dispatcher and workers in background. Jobs of clusters and
+// backends not registered until then are dropped.
+func (rq *ReplicationQueue) Start() {
+	rq.dropUnconfigured()
+	for i := 0; i < rq.conf.Workers; i++ {
+		go rq.worker()
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			rq.dispatch()
+			select {
+			case <-ticker.C:
+			case <-rq.notify:
+			case <-rq.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop terminates dispatcher and workers, queued jobs stay on disk
+func (rq *ReplicationQueue) Stop() {
+	rq.stopOnce.Do(func() { close(rq.stop) })
+}
+
+// dropUnconfigured drops jobs of backends removed from configuration, they
+// would never be dispatched
+func (rq *ReplicationQueue) dropUnconfigured() {
+	rq.mx.Lock()
+	defer rq.mx.Unlock()
+	for id, job := range rq.jobs {
+		cluster := rq.clusters[job.Cluster]
+		remaining := []string{}
+		for _, backend := range job.Backends {
+			if cluster.backends[backend] {
+				remaining = append(remaining, backend)
+				continue
+			}
+			log.Printf("Replication of request %s to %s of cluster %s dropped, backend is not configured", job.ReqID, backend, job.Cluster)
+			metrics.Mark("replication.dropped")
+			rq.dropped(job, backend, errBackendNotConfigured)
+		}
+		if len(remaining) == len(job.Backends) {
+			continue
+		}
+		if len(remaining) == 0 {
+			rq.remove(id)
+			continue
+		}
+		job.Backends = remaining
+		if err := rq.persist(job); err != nil {
+			log.Printf("Could not persist replication job %s: %s", id, err)
+		}
+	}
+	metrics.UpdateGauge("replication.queue.depth", int64(len(rq.jobs)))
+}
+
+func (rq *ReplicationQueue) wakeUp() {
+	select {
+	case rq.notify <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch passes due jobs to workers and updates queue metrics. Job is
+// due only if there are no older jobs of the same object.
+func (rq *ReplicationQueue) dispatch() {
+	now := time.Now()
+	rq.mx.Lock()
+	jobs := make([]*replicationJob, 0, len(rq.jobs))
+	for _, job := range rq.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].before(jobs[j]) })
+	due := []replicationJob{}
+	oldest := now
+	queuedObjects := make(map[string]bool)
+	for _, job := range jobs {
+		id := job.ID
+		if job.Created.Before(oldest) {
+			oldest = job.Created
+		}
+		objectKey := job.objectKey()
+		if queuedObjects[objectKey] {
+			continue
+		}
+		queuedObjects[objectKey] = true
+		if rq.inProgress[id] || job.NextAttempt.After(now) {
+			continue
+		}
+		if _, ok := rq.clusters[job.Cluster]; !ok {
+			continue
+		}
+		rq.inProgress[id] = true
+		due = append(due, *job)
+	}
+	metrics.UpdateGauge("replication.queue.depth", int64(len(rq.jobs)))
+	metrics.UpdateGauge("replication.queue.age", int64(now.Sub(oldest).Seconds()))
+	rq.mx.Unlock()
+
+	for _, job := range due {
+		select {
+		case rq.work <- job:
+		case <-rq.stop:
+			return
+		}
+	}
+}
+
+func (rq *ReplicationQueue) worker() {
+	for {
+		select {
+		case job := <-rq.work:
+			rq.process(job)
+		case <-rq.stop:
+			return
+		}
+	}
+}
+
+// process sends job to remaining backends, job is removed once all of
+// them succeed or it's out of attempts
+func (rq *ReplicationQueue) process(job replicationJob) {
+	rq.mx.Lock()
+	cluster := rq.clusters[job.Cluster]
+	rq.mx.Unlock()
+
+	remaining := []string{}
+	var lastErr error
+	for _, backend := range job.Backends {
+		if err := rq.replicate(cluster, job, backend); err != nil {
+			log.Debugf("Replication of request %s to %s failed: %s", job.ReqID, backend, err)
+			remaining = append(remaining, backend)
+			lastErr = err
+			continue
+		}
+		metrics.Mark("replication.success")
+	}
+
+	rq.mx.Lock()
+	defer rq.mx.Unlock()
+	delete(rq.inProgress, job.ID)
+	stored, ok := rq.jobs[job.ID]
+	if !ok {
+		return
+	}
+	stored.Backends = remaining
+	if len(remaining) == 0 {
+		rq.remove(job.ID)
+		return
+	}
+	metrics.Mark("replication.failure")
+	stored.Attempts++
+	if stored.Attempts >= rq.conf.MaxAttempts {
+		log.Printf("Replication of request %s dropped after %d attempts, last error: %s", job.ReqID, stored.Attempts, lastErr)
+		for _, backend := range remaining {
+			metrics.Mark("replication.dropped")
+			rq.dropped(stored, backend, lastErr)
+		}
+		rq.remove(job.ID)
+		return
+	}
+	stored.NextAttempt = time.Now().Add(rq.conf.RetryInterval)
+	if err := rq.persist(stored); err != nil {
+		log.Printf("Could not persist replication job %s: %s", job.ID, err)
+	}
+}
+
+func (rq *ReplicationQueue) dropped(job *replicationJob, backend string, err error) {
+	if rq.Dropped == nil {
+		return
+	}
+	host := backend
+	if i := strings.Index(backend, "://"); i >= 0 {
+		host = backend[i+3:]
+	}
+	rq.Dropped(ReplicationFailure{
+		Method:        job.Method,
+		Host:          host,
+		Path:          job.objectPath(),
+		SuccessHost:   job.SuccessHost,
+		UserAgent:     job.Header.Get("User-Agent"),
+		ReqID:         job.ReqID,
+		Error:         err.Error(),
+		ContentLength: job.ContentLength,
+	})
+}
+
+func (rq *ReplicationQueue) replicate(cluster clusterReplication, job replicationJob, backend string) error {
+	var body io.ReadCloser
+	if job.ContentLength > 0 {
+		file, err := os.Open(rq.bodyPath(job.ID))
+		if err != nil {
+			return err
+		}
+		body = file
+	}
+	req, err := http.NewRequest(job.Method, backend+job.RequestURI, body)
+	if err != nil {
+		if body != nil {
+			closeRequestBody(&http.Request{Body: body})
+		}
+		return err
+	}
+	req.Header = cloneHeader(job.Header)
+	req.ContentLength = job.ContentLength
+	req = req.WithContext(context.WithValue(context.Background(), log.ContextreqIDKey, job.ReqID))
+	if cluster.process != nil {
+		// client request is gone, it's rebuilt from job
+		orig, err := http.NewRequest(job.Method, job.RequestURI, nil)
+		if err != nil {
+			closeRequestBody(req)
+			return err
+		}
+		orig.Header = cloneHeader(job.Header)
+		cluster.process(orig, []*http.Request{req})
+	}
+	resp, err := cluster.roundTripper.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	discardResponse(resp)
+	if resp.StatusCode >= 400 && !(job.Method == http.MethodDelete && resp.StatusCode == http.StatusNotFound) {
+		return fmt.Errorf("backend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// persist writes job metadata atomically, must be called with mx locked
+func (rq *ReplicationQueue) persist(job *replicationJob) error {
+	content, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(rq.jobPath(job.ID), content)
+}
+
+// writeFileSync replaces file atomically and durably, content is synced
+// before temporary file is renamed and directory is synced after rename
+func writeFileSync(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes directory entries durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		_ = dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+// remove deletes job files, must be called with mx locked
+func (rq *ReplicationQueue) remove(id string) {
+	delete(rq.jobs, id)
+	for _, path := range []string{rq.jobPath(id), rq.bodyPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove replication file %s: %s", path, err)
+		}
+	}
+	metrics.UpdateGauge("replication.queue.depth", int64(len(rq.jobs)))
+}
+
+// supersede removes queued jobs of object overwritten by job, which will
+// reach all backends anyway. Jobs in progress are left, job waits for them
+// and is queued also for backend which acknowledged it, see commit. Must be
+// called with mx locked.
+func (rq *ReplicationQueue) supersede(job *replicationJob) {
+	if !job.supersedes() {
+		return
+	}
+	objectKey := job.objectKey()
+	for id, older := range rq.jobs {
+		if rq.inProgress[id] || older.objectKey() != objectKey || !older.before(job) {
+			continue
+		}
+		log.Debugf("Replication of request %s superseded by request %s", older.ReqID, job.ReqID)
+		metrics.Mark("replication.superseded")
+		rq.remove(id)
+	}
+}
+
+// olderJobTargets reports if backend has to get job again after older job
+// of the same object, which is in progress or not superseded by job, is
+// replicated to backend. Must be called with mx locked.
+func (rq *ReplicationQueue) olderJobTargets(job *replicationJob, backend string) bool {
+	objectKey := job.objectKey()
+	for id, older := range rq.jobs {
+		if older.objectKey() != objectKey || !older.before(job) {
+			continue
+		}
+		if !rq.inProgress[id] && job.supersedes() {
+			continue
+		}
+		for _, target := range older.Backends {
+			if target == backend {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AsyncReplication acknowledges writes after first backend succeeds, other
+// backends get the write from ReplicationQueue
+type AsyncReplication struct {
+	queue   *ReplicationQueue
+	cluster string
+}
+
+// pendingReplication is job which body is stored, but it's not queued
+// until commit
+type pendingReplication struct {
+	queue *ReplicationQueue
+	job   replicationJob
+}
+
+func newReplicationID() string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+}
+
+// prepare stores request body on disk
+func (ar *AsyncReplication) prepare(req *http.Request) (*pendingReplication, error) {
+	id := newReplicationID()
+	file, err := os.OpenFile(ar.queue.bodyPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	pr := &pendingReplication{queue: ar.queue}
+	n, err := io.Copy(file, clientBodyReader(req))
+	if err == nil && n < req.ContentLength {
+		err = ErrBodyContentLengthMismatch
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	reqID, _ := req.Context().Value(log.ContextreqIDKey).(string)
+	pr.job = replicationJob{
+		ID:            id,
+		Cluster:       ar.cluster,
+		Method:        req.Method,
+		RequestURI:    req.URL.RequestURI(),
+		Header:        cloneHeader(req.Header),
+		ContentLength: n,
+		ReqID:         reqID,
+		Created:       time.Now(),
+	}
+	if err != nil {
+		pr.discard()
+		return nil, err
+	}
+	return pr, nil
+}
+
+func cloneHeader(header http.Header) http.Header {
+	clone := make(http.Header, len(header))
+	for k, v := range header {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
+
+// body returns new reader of stored body
+func (pr *pendingReplication) body() (io.ReadCloser, error) {
+	if pr.job.ContentLength == 0 {
+		return http.NoBody, nil
+	}
+	return os.Open(pr.queue.bodyPath(pr.job.ID))
+}
+
+// commit queues job for given backends. Write is queued also for backend
+// which acknowledged it, if older write of the same object is still to be
+// replicated there, so it's not overwritten by the older one.
+func (pr *pendingReplication) commit(success url.URL, backends []string) error {
+	pr.job.SuccessHost = success.Host
+	pr.job.Backends = backends
+	job := pr.job
+	pr.queue.mx.Lock()
+	if successURL := backendURL(success); pr.queue.olderJobTargets(&job, successURL) {
+		log.Debugf("Write request %s queued also for %s, older write of object is pending there", job.ReqID, success.Host)
+		job.Backends = append(job.Backends, successURL)
+	}
+	if len(job.Backends) == 0 {
+		pr.queue.mx.Unlock()
+		pr.discard()
+		return nil
+	}
+	err := pr.queue.persist(&job)
+	if err == nil {
+		pr.queue.supersede(&job)
+		pr.queue.jobs[job.ID] = &job
+	}
+	pr.queue.mx.Unlock()
+	if err != nil {
+		pr.discard()
+		return err
+	}
+	pr.queue.wakeUp()
+	return nil
+}
+
+// discard removes stored body
+func (pr *pendingReplication) discard() {
+	if err := os.Remove(pr.queue.bodyPath(pr.job.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove replication body %s: %s", pr.job.ID, err)
+	}
+}
+
+// isAsyncReplicable reports if write can be repeated later on other
+// backends. Multipart uploads are excluded, as upload ids differ between
+// backends.
+func isAsyncReplicable(req *http.Request) bool {
+	if req.Method != http.MethodPut && req.Method != http.MethodDelete {
+		return false
+	}
+	query := req.URL.Query()
+	_, uploadID := query["uploadId"]
+	_, uploads := query["uploads"]
+	return !uploadID && !uploads
+}
+
+// asyncWrite sends write to backends one by one until first success,
+// then queues it for remaining backends, including failed ones
+func (mt *MultiTransport) asyncWrite(req *http.Request, ctx context.Context) (*http.Response, error) {
+	backends := mt.Backends
+	if mt.ReadPolicy != nil {
+		backends = mt.ReadPolicy.Order(backends)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("No requests provided")
+	}
+	pending, err := mt.Async.prepare(req)
+	if err != nil {
+		return nil, err
+	}
+	failed := []ReqResErrTuple{}
+	for i, backend := range backends {
+		body, err := pending.body()
+		if err != nil {
+			pending.discard()
+			return nil, err
+		}
+		r, err := newBackendRequest(req, backend, body, pending.job.ContentLength)
+		if err != nil {
+			closeRequestBody(&http.Request{Body: body})
+			pending.discard()
+			return nil, err
+		}
+		r.GetBody = pending.body
+		mt.preProcess(req, r)
+		attempt := make(chan ReqResErrTuple, 1)
+		mt.sendRequest(r.WithContext(ctx), attempt)
+		tup := <-attempt
+		if tup.Failed {
+			log.Debugf("Write request %s failed on %s, trying next backend", ctx.Value(log.ContextreqIDKey), backend.Host)
+			failed = append(failed, tup)
+			continue
+		}
+		discardResponses(failed)
+		others := make([]string, 0, len(backends)-1)
+		for j, other := range backends {
+			if j != i {
+				others = append(others, backendURL(other))
+			}
+		}
+		if err := pending.commit(backend, others); err != nil {
+			log.Printf("Could not queue replication of request %s: %s", ctx.Value(log.ContextreqIDKey), err)
+			metrics.Mark("replication.queue.error")
+			discardResponses([]ReqResErrTuple{tup})
+			return nil, err
+		}
+		return tup.Res, tup.Err
+	}
+	pending.discard()
+	c := make(chan ReqResErrTuple, len(failed))
+	for _, tup := range failed {
+		c <- tup
+	}
+	close(c)
+	resTup := mt.HandleResponses(c)
+	return resTup.Res, resTup.Err
+}
+
+func discardResponses(tups []ReqResErrTuple) {
+	for _, tup := range tups {
+		if tup.Res != nil {
+			discardResponse(tup.Res)
+		}
+	}
+}
+
+// backendURL returns backend scheme and host, scheme defaults to http
+func backendURL(backend url.URL) string {
+	scheme := backend.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + backend.Host
+}
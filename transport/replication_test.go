@@ -0,0 +1,371 @@
+package transport
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type writesRecorder struct {
+	mx      sync.Mutex
+	bodies  map[string]string
+	failing map[string]bool
+}
+
+func (wr *writesRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var b []byte
+	if req.Body != nil {
+		var err error
+		if b, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	wr.mx.Lock()
+	defer wr.mx.Unlock()
+	status := http.StatusOK
+	if wr.failing[req.URL.Host] {
+		status = http.StatusInternalServerError
+	} else {
+		wr.bodies[req.URL.Host] = string(b)
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(strings.NewReader("content")), Request: req}, nil
+}
+
+func (wr *writesRecorder) written(host string) (string, bool) {
+	wr.mx.Lock()
+	defer wr.mx.Unlock()
+	body, ok := wr.bodies[host]
+	return body, ok
+}
+
+func (wr *writesRecorder) setFailing(host string, failing bool) {
+	wr.mx.Lock()
+	defer wr.mx.Unlock()
+	wr.failing[host] = failing
+}
+
+func waitForEmptyQueue(t *testing.T, queue *ReplicationQueue) {
+	deadline := time.Now().Add(5 * time.Second)
+	for queue.Len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replication queue not empty, %d jobs left", queue.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAsyncWriteIsQueuedAndSurvivesRestart(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := &writesRecorder{bodies: map[string]string{}, failing: map[string]bool{"b": true}}
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir})
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("body")))
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, ok := recorder.written("a")
+	assert.True(t, ok)
+	assert.Equal(t, "body", body)
+	assert.Equal(t, 1, queue.Len())
+
+	restarted, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir, RetryInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, 1, restarted.Len(), "Queued job should be loaded after restart")
+	recorder.setFailing("b", false)
+	restarted.ForCluster("cluster", mkBackends("a", "b"), recorder, nil)
+	restarted.Start()
+	defer restarted.Stop()
+	waitForEmptyQueue(t, restarted)
+
+	body, ok = recorder.written("b")
+	assert.True(t, ok)
+	assert.Equal(t, "body", body)
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestAsyncWriteFailsIfAllBackendsFail(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := &writesRecorder{bodies: map[string]string{}, failing: map[string]bool{"a": true, "b": true}}
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir})
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("body")))
+	resp, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, 0, queue.Len())
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Empty(t, files, "Body of failed write should be removed")
+}
+
+func TestReplicationQueueDropsJobAfterMaxAttempts(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := &writesRecorder{bodies: map[string]string{}, failing: map[string]bool{"b": true}}
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir, MaxAttempts: 2, RetryInterval: time.Millisecond})
+	require.NoError(t, err)
+	dropped := make(chan ReplicationFailure, 1)
+	queue.Dropped = func(failure ReplicationFailure) { dropped <- failure }
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+	queue.Start()
+	defer queue.Stop()
+
+	req, _ := http.NewRequest("DELETE", "http://example.com/bucket/key", nil)
+	_, err = transp.RoundTrip(req)
+	require.NoError(t, err)
+
+	select {
+	case failure := <-dropped:
+		assert.Equal(t, "b", failure.Host)
+		assert.Equal(t, "a", failure.SuccessHost)
+		assert.Equal(t, "/bucket/key", failure.Path)
+		assert.Equal(t, "DELETE", failure.Method)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Job should be dropped")
+	}
+	waitForEmptyQueue(t, queue)
+}
+
+func TestUncommittedReplicationBodiesAreRemovedOnLoad(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	orphan := filepath.Join(dir, "1-orphan"+replicationBodySuffix)
+	require.NoError(t, ioutil.WriteFile(orphan, []byte("body"), 0600))
+
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir})
+	require.NoError(t, err)
+	assert.Equal(t, 0, queue.Len())
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMultipartUploadsAreNotAsyncReplicable(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key?partNumber=1&uploadId=abc", nil)
+	assert.False(t, isAsyncReplicable(req))
+	req, _ = http.NewRequest("POST", "http://example.com/bucket/key?uploads", nil)
+	assert.False(t, isAsyncReplicable(req))
+	req, _ = http.NewRequest("PUT", "http://example.com/bucket/key", nil)
+	assert.True(t, isAsyncReplicable(req))
+}
+
+// objectsRecorder keeps objects written to each host and order of writes
+type objectsRecorder struct {
+	mx      sync.Mutex
+	objects map[string]map[string]string
+	writes  map[string][]string
+	failing map[string]bool
+}
+
+func newObjectsRecorder(failing ...string) *objectsRecorder {
+	or := &objectsRecorder{
+		objects: map[string]map[string]string{},
+		writes:  map[string][]string{},
+		failing: map[string]bool{},
+	}
+	for _, host := range failing {
+		or.failing[host] = true
+	}
+	return or
+}
+
+func (or *objectsRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var b []byte
+	if req.Body != nil {
+		var err error
+		if b, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+	}
+	// give other workers a chance to interleave
+	time.Sleep(5 * time.Millisecond)
+	or.mx.Lock()
+	defer or.mx.Unlock()
+	host := req.URL.Host
+	if or.failing[host] {
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody, Request: req}, nil
+	}
+	if or.objects[host] == nil {
+		or.objects[host] = map[string]string{}
+	}
+	or.writes[host] = append(or.writes[host], req.Method+" "+req.URL.RequestURI())
+	switch {
+	case req.Method == http.MethodDelete:
+		delete(or.objects[host], req.URL.Path)
+	case req.URL.RawQuery == "":
+		or.objects[host][req.URL.Path] = string(b)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func (or *objectsRecorder) object(host, path string) (string, bool) {
+	or.mx.Lock()
+	defer or.mx.Unlock()
+	body, ok := or.objects[host][path]
+	return body, ok
+}
+
+func (or *objectsRecorder) setFailing(host string, failing bool) {
+	or.mx.Lock()
+	defer or.mx.Unlock()
+	or.failing[host] = failing
+}
+
+func TestQueuedDeleteIsNotOverwrittenByOlderPut(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := newObjectsRecorder("b")
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir, RetryInterval: time.Millisecond})
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+
+	put, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("body")))
+	_, err = transp.RoundTrip(put)
+	require.NoError(t, err)
+	del, _ := http.NewRequest("DELETE", "http://example.com/bucket/key", nil)
+	_, err = transp.RoundTrip(del)
+	require.NoError(t, err)
+	assert.Equal(t, 1, queue.Len(), "PUT should be superseded by DELETE")
+
+	recorder.setFailing("b", false)
+	queue.Start()
+	defer queue.Stop()
+	waitForEmptyQueue(t, queue)
+
+	_, ok := recorder.object("b", "/bucket/key")
+	assert.False(t, ok, "Deleted object shouldn't be replicated")
+	assert.Equal(t, []string{"DELETE /bucket/key"}, recorder.writes["b"])
+}
+
+func TestReplicationJobsOfObjectAreProcessedInOrder(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := newObjectsRecorder("b")
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir, Workers: 4, RetryInterval: time.Millisecond})
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+
+	expected := []string{"PUT /bucket/key"}
+	put, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("body")))
+	_, err = transp.RoundTrip(put)
+	require.NoError(t, err)
+	for _, subresource := range []string{"acl", "tagging", "retention"} {
+		req, _ := http.NewRequest("PUT", "http://example.com/bucket/key?"+subresource, bytes.NewReader([]byte(subresource)))
+		_, err = transp.RoundTrip(req)
+		require.NoError(t, err)
+		expected = append(expected, "PUT /bucket/key?"+subresource)
+	}
+	require.Equal(t, 4, queue.Len())
+
+	recorder.setFailing("b", false)
+	queue.Start()
+	defer queue.Stop()
+	waitForEmptyQueue(t, queue)
+
+	recorder.mx.Lock()
+	defer recorder.mx.Unlock()
+	assert.Equal(t, expected, recorder.writes["b"])
+}
+
+func TestWriteAcknowledgedDuringOlderReplicationIsReplicatedAgain(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := newObjectsRecorder("b")
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir, RetryInterval: time.Millisecond})
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+
+	old, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("old")))
+	_, err = transp.RoundTrip(old)
+	require.NoError(t, err)
+	require.Equal(t, 1, queue.Len())
+	// replication of old write to b is in flight while new write lands there
+	queue.mx.Lock()
+	for id := range queue.jobs {
+		queue.inProgress[id] = true
+	}
+	queue.mx.Unlock()
+	recorder.setFailing("a", true)
+	recorder.setFailing("b", false)
+	current, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("new")))
+	_, err = transp.RoundTrip(current)
+	require.NoError(t, err)
+	require.Equal(t, 2, queue.Len(), "write in flight shouldn't be superseded")
+
+	queue.mx.Lock()
+	queue.inProgress = map[string]bool{}
+	queue.mx.Unlock()
+	recorder.setFailing("a", false)
+	queue.Start()
+	defer queue.Stop()
+	waitForEmptyQueue(t, queue)
+
+	for _, host := range []string{"a", "b"} {
+		body, ok := recorder.object(host, "/bucket/key")
+		assert.True(t, ok, host)
+		assert.Equal(t, "new", body, host)
+	}
+}
+
+func TestJobsOfUnconfiguredBackendsAreDroppedOnStart(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	recorder := &writesRecorder{bodies: map[string]string{}, failing: map[string]bool{"b": true, "c": true, "d": true}}
+	queue, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir})
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b", "c"), recorder, t)
+	transp.Async = queue.ForCluster("cluster", transp.Backends, recorder, nil)
+	removed := mkTransportWithRoundTripper(mkBackends("a", "d"), recorder, t)
+	removed.Async = queue.ForCluster("removed", removed.Backends, recorder, nil)
+	for _, mt := range []*MultiTransport{transp, removed} {
+		req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewReader([]byte("body")))
+		_, err = mt.RoundTrip(req)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, queue.Len())
+
+	restarted, err := NewReplicationQueue(ReplicationQueueConfig{Dir: dir, RetryInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	dropped := make(chan ReplicationFailure, 2)
+	restarted.Dropped = func(failure ReplicationFailure) { dropped <- failure }
+	recorder.setFailing("b", false)
+	restarted.ForCluster("cluster", mkBackends("a", "b"), recorder, nil)
+	restarted.Start()
+	defer restarted.Stop()
+	waitForEmptyQueue(t, restarted)
+
+	close(dropped)
+	hosts := []string{}
+	for failure := range dropped {
+		assert.Equal(t, errBackendNotConfigured.Error(), failure.Error)
+		hosts = append(hosts, failure.Host)
+	}
+	sort.Strings(hosts)
+	assert.Equal(t, []string{"c", "d"}, hosts)
+	body, ok := recorder.written("b")
+	assert.True(t, ok)
+	assert.Equal(t, "body", body)
+}
@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+	defaultRetryBudget         = 5 * time.Second
+)
+
+// RetryPolicy defines how idempotent backend requests failed with network
+// error or 5xx status are retried
+type RetryPolicy struct {
+	// MaxAttempts is total number of attempts, including first one
+	MaxAttempts int
+	// InitialBackoff is wait time before first retry, doubled on next ones
+	InitialBackoff time.Duration
+	// MaxBackoff limits wait time between attempts
+	MaxBackoff time.Duration
+	// Budget limits total time spent on all attempts
+	Budget time.Duration
+}
+
+func (rp RetryPolicy) withDefaults() RetryPolicy {
+	if rp.MaxAttempts <= 0 {
+		rp.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if rp.InitialBackoff <= 0 {
+		rp.InitialBackoff = defaultRetryInitialBackoff
+	}
+	if rp.MaxBackoff <= 0 {
+		rp.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if rp.Budget <= 0 {
+		rp.Budget = defaultRetryBudget
+	}
+	return rp
+}
+
+// backoff returns wait time before given retry, with jitter
+func (rp RetryPolicy) backoff(retry int) time.Duration {
+	backoff := rp.InitialBackoff
+	for i := 1; i < retry && backoff < rp.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > rp.MaxBackoff {
+		backoff = rp.MaxBackoff
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// isRetryable reports if request is idempotent and its body can be replayed
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	return err != nil || resp != nil && resp.StatusCode >= 500
+}
+
+// WithRetriesCounter returns context in which backend request retries
+// are counted
+func WithRetriesCounter(ctx context.Context) context.Context {
+	return context.WithValue(ctx, log.ContextRetriesKey, new(int32))
+}
+
+// Retries returns number of backend request retries counted in context
+func Retries(ctx context.Context) int32 {
+	counter, ok := ctx.Value(log.ContextRetriesKey).(*int32)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt32(counter)
+}
+
+func countRetry(ctx context.Context) {
+	if counter, ok := ctx.Value(log.ContextRetriesKey).(*int32); ok {
+		atomic.AddInt32(counter, 1)
+	}
+}
+
+// roundTripWithRetries sends request to backend, repeating it according
+// to Retries policy
+func (mt *MultiTransport) roundTripWithRetries(req *http.Request, rtCtx context.Context) (*http.Response, error) {
+	start := time.Now()
+	resp, err := mt.RoundTripper.RoundTrip(req.WithContext(rtCtx))
+	if mt.Retries == nil || !isRetryable(req) {
+		return resp, err
+	}
+	policy := mt.Retries.withDefaults()
+	deadline := start.Add(policy.Budget)
+	reqID := req.Context().Value(log.ContextreqIDKey)
+	for attempt := 1; attempt < policy.MaxAttempts && shouldRetry(resp, err); attempt++ {
+		if rtCtx.Err() != nil {
+			break
+		}
+		wait := policy.backoff(attempt)
+		if time.Now().Add(wait).After(deadline) {
+			log.Debugf("Retry budget exceeded for request %s, on %s", reqID, req.URL.Host)
+			break
+		}
+		retryReq, rerr := rewindRequest(req)
+		if rerr != nil {
+			log.Debugf("Cannot rewind request %s body: %s", reqID, rerr)
+			break
+		}
+		discardResponse(resp)
+		select {
+		case <-time.After(wait):
+		case <-rtCtx.Done():
+			return nil, rtCtx.Err()
+		}
+		log.Debugf("Retrying request %s, on %s, attempt %d", reqID, req.URL.Host, attempt+1)
+		metrics.Mark("reqs.backend." + metrics.Clean(req.URL.Host) + ".retry")
+		countRetry(req.Context())
+		req = retryReq
+		resp, err = mt.RoundTripper.RoundTrip(req.WithContext(rtCtx))
+	}
+	return resp, err
+}
+
+// rewindRequest returns request copy with fresh body
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	r := new(http.Request)
+	*r = *req
+	if req.GetBody == nil {
+		return r, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = body
+	return r, nil
+}
+
+func discardResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		log.Debugf("Could not discard response body %s", err)
+	}
+	if err := resp.Body.Close(); err != nil {
+		log.Debugf("Could not close response body %s", err)
+	}
+}
@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryBackoffIsLimited(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}.withDefaults()
+	for retry := 1; retry < 10; retry++ {
+		backoff := policy.backoff(retry)
+		assert.True(t, backoff >= 5*time.Millisecond, "backoff too short %s", backoff)
+		assert.True(t, backoff <= 30*time.Millisecond, "backoff too long %s", backoff)
+	}
+}
+
+func TestRetriesReplayRequestBody(t *testing.T) {
+	bodies := []string{}
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(b))
+		if len(bodies) < 3 {
+			return nil, errors.New("connection reset by peer")
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a"), rt, t)
+	transp.Retries = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("content"))
+	ctx := WithRetriesCounter(req.Context())
+	resp, err := transp.RoundTrip(req.WithContext(ctx))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"content", "content", "content"}, bodies)
+	assert.Equal(t, int32(2), Retries(ctx))
+}
+
+func TestRetriesSkipNonIdempotentAndClientErrors(t *testing.T) {
+	calls := 0
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		if req.Method == http.MethodPost {
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+		}
+		return &http.Response{StatusCode: http.StatusForbidden, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a"), rt, t)
+	transp.Retries = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	req, _ := http.NewRequest("POST", "http://example.com/bucket/key?uploads", nil)
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+	req, _ = http.NewRequest("GET", "http://example.com/bucket/key", nil)
+	_, err = transp.RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestRetryBudgetIncludesFirstAttempt(t *testing.T) {
+	calls := 0
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		time.Sleep(30 * time.Millisecond)
+		return nil, errors.New("connection reset by peer")
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a"), rt, t)
+	transp.Retries = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Budget: 20 * time.Millisecond}
+
+	req, _ := http.NewRequest("GET", "http://a/bucket/key", nil)
+	ctx := WithRetriesCounter(req.Context())
+	_, err := transp.roundTripWithRetries(req.WithContext(ctx), context.Background())
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int32(0), Retries(ctx))
+}
+
+func TestRetryNotCountedWhenCancelledDuringBackoff(t *testing.T) {
+	rtCtx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls++
+		time.AfterFunc(10*time.Millisecond, cancel)
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a"), rt, t)
+	transp.Retries = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Second}
+
+	req, _ := http.NewRequest("GET", "http://a/bucket/key", nil)
+	ctx := WithRetriesCounter(req.Context())
+	_, err := transp.roundTripWithRetries(req.WithContext(ctx), rtCtx)
+
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, int32(0), Retries(ctx))
+}
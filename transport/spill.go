@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/allegro/akubra/log"
+	"github.com/allegro/akubra/metrics"
+)
+
+const spillFilePrefix = "akubra-body-"
+
+// ErrSpillSpaceExhausted is returned if request body would exceed
+// BodySpill MaxSize
+var ErrSpillSpaceExhausted = errors.New("No space left for request body spill")
+
+var errSpillDirNotSet = errors.New("Body spill directory not set")
+
+var errSpilledBodyReleased = errors.New("Spilled request body already released")
+
+// BodySpill configures buffering of large request bodies in temporary
+// files instead of memory. Single BodySpill should be shared by all
+// MultiTransports, so MaxSize limits disk usage of whole proxy.
+type BodySpill struct {
+	// Threshold is body size above which body is written to disk
+	Threshold int64
+	// Dir is temporary files directory, it must not be shared as
+	// files left there are removed by CleanupSpillDir
+	Dir string
+	// MaxSize limits total size of spilled bodies, zero means no limit
+	MaxSize int64
+	used    int64
+}
+
+func (bs *BodySpill) reserve(size int64) bool {
+	if atomic.AddInt64(&bs.used, size) > bs.MaxSize && bs.MaxSize > 0 {
+		atomic.AddInt64(&bs.used, -size)
+		return false
+	}
+	metrics.UpdateGauge("reqs.spill.bytes", atomic.LoadInt64(&bs.used))
+	return true
+}
+
+func (bs *BodySpill) free(size int64) {
+	metrics.UpdateGauge("reqs.spill.bytes", atomic.AddInt64(&bs.used, -size))
+}
+
+// spill copies body to temporary file. Space for body of unknown (negative)
+// size is reserved once body is read.
+func (bs *BodySpill) spill(body io.Reader, size int64) (*spilledBody, error) {
+	reserved := size
+	if reserved < 0 {
+		reserved = 0
+	}
+	if !bs.reserve(reserved) {
+		return nil, ErrSpillSpaceExhausted
+	}
+	file, err := ioutil.TempFile(bs.Dir, spillFilePrefix)
+	if err != nil {
+		bs.free(reserved)
+		return nil, err
+	}
+	sb := &spilledBody{file: file, size: reserved, spill: bs, refs: 1}
+	n, err := io.Copy(file, body)
+	if err == nil && n < size {
+		err = ErrBodyContentLengthMismatch
+	}
+	if err == nil && size < 0 {
+		if bs.reserve(n) {
+			sb.size = n
+		} else {
+			err = ErrSpillSpaceExhausted
+		}
+	}
+	if err != nil {
+		sb.release()
+		return nil, err
+	}
+	metrics.Mark("reqs.spill.bodies")
+	return sb, nil
+}
+
+// CleanupSpillDir removes temporary files left by previous process,
+// must be called before any body is spilled. Dir is required, so files of
+// other processes in system temporary directory are not removed.
+func CleanupSpillDir(dir string) error {
+	if dir == "" {
+		return errSpillDirNotSet
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, spillFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		log.Printf("Removed orphaned request body file %s", path)
+	}
+	return nil
+}
+
+// spilledBody is reference counted temporary file, removed once all its
+// readers and owner release it
+type spilledBody struct {
+	file  *os.File
+	size  int64
+	spill *BodySpill
+	mx    sync.Mutex
+	refs  int
+}
+
+// reader returns independent body reader, it can be used as
+// http.Request GetBody
+func (sb *spilledBody) reader() (io.ReadCloser, error) {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+	if sb.refs == 0 {
+		return nil, errSpilledBodyReleased
+	}
+	sb.refs++
+	return &spilledBodyReader{SectionReader: io.NewSectionReader(sb.file, 0, sb.size), body: sb}, nil
+}
+
+func (sb *spilledBody) release() {
+	sb.mx.Lock()
+	defer sb.mx.Unlock()
+	sb.refs--
+	if sb.refs > 0 {
+		return
+	}
+	if err := sb.file.Close(); err != nil {
+		log.Debugf("Could not close request body file %s: %s", sb.file.Name(), err)
+	}
+	if err := os.Remove(sb.file.Name()); err != nil {
+		log.Printf("Could not remove request body file %s: %s", sb.file.Name(), err)
+	}
+	sb.spill.free(sb.size)
+}
+
+type spilledBodyReader struct {
+	*io.SectionReader
+	body *spilledBody
+	once sync.Once
+}
+
+// Close releases spilled body, file is not closed until all readers
+// are closed
+func (sbr *spilledBodyReader) Close() error {
+	sbr.once.Do(sbr.body.release)
+	return nil
+}
@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mkSpillDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "akubra-spill-test")
+	require.NoError(t, err)
+	return dir
+}
+
+func spillFiles(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, spillFilePrefix+"*"))
+	require.NoError(t, err)
+	return paths
+}
+
+func TestSpilledBodyIsReplicatedAndRemoved(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	mx := sync.Mutex{}
+	bodies := map[string]string{}
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		require.NoError(t, req.Body.Close())
+		mx.Lock()
+		bodies[req.URL.Host] = string(b)
+		mx.Unlock()
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), rt, t)
+	transp.Spill = &BodySpill{Threshold: 4, Dir: dir}
+
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", bytes.NewBufferString("large content"))
+	_, err := transp.RoundTrip(req)
+	require.NoError(t, err)
+
+	for i := 0; i < 100 && len(spillFiles(t, dir)) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, spillFiles(t, dir))
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, map[string]string{"a": "large content", "b": "large content"}, bodies)
+}
+
+func TestSpillRejectsBodiesOverMaxSize(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	spill := &BodySpill{Dir: dir, MaxSize: 4}
+	_, err := spill.spill(bytes.NewBufferString("large content"), 13)
+	assert.Equal(t, ErrSpillSpaceExhausted, err)
+	assert.Empty(t, spillFiles(t, dir))
+}
+
+func TestCleanupSpillDirRemovesOrphans(t *testing.T) {
+	dir := mkSpillDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+	other := filepath.Join(dir, "other")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, spillFilePrefix+"123"), []byte("x"), 0600))
+	require.NoError(t, ioutil.WriteFile(other, []byte("x"), 0600))
+
+	require.NoError(t, CleanupSpillDir(dir))
+	assert.Empty(t, spillFiles(t, dir))
+	_, err := os.Stat(other)
+	assert.NoError(t, err)
+	assert.Error(t, CleanupSpillDir(""), "System temporary directory should not be cleaned up")
+}
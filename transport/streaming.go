@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/akubra/log"
+)
+
+const (
+	defaultStreamChunkSize          = 32 * 1024
+	defaultStreamQueueLength        = 16
+	defaultStreamSlowBackendTimeout = time.Second
+)
+
+// ErrSlowBackend is returned to backend request body reader if backend
+// could not keep up with other backends while body was streamed
+var ErrSlowBackend = errors.New("Backend too slow, dropped from body streaming")
+
+// BodyStreaming configures fan-out streaming of request bodies. Instead of
+// buffering whole body in memory, client body is read in chunks and each
+// chunk is passed to every backend through bounded queue.
+type BodyStreaming struct {
+	// ChunkSize is size of single read from client body
+	ChunkSize int
+	// QueueLength is number of chunks which may wait for single backend
+	QueueLength int
+	// SlowBackendTimeout is how long full backend queue is awaited before
+	// backend is dropped
+	SlowBackendTimeout time.Duration
+}
+
+func (bs *BodyStreaming) chunkSize() int {
+	if bs.ChunkSize > 0 {
+		return bs.ChunkSize
+	}
+	return defaultStreamChunkSize
+}
+
+func (bs *BodyStreaming) queueLength() int {
+	if bs.QueueLength > 0 {
+		return bs.QueueLength
+	}
+	return defaultStreamQueueLength
+}
+
+func (bs *BodyStreaming) slowBackendTimeout() time.Duration {
+	if bs.SlowBackendTimeout > 0 {
+		return bs.SlowBackendTimeout
+	}
+	return defaultStreamSlowBackendTimeout
+}
+
+// streamTarget is a single backend body pipe fed by fanOut
+type streamTarget struct {
+	host    string
+	chunks  chan []byte
+	writer  *io.PipeWriter
+	dropped int32
+	done    chan struct{}
+}
+
+func newStreamTarget(host string, queueLength int) (*streamTarget, *io.PipeReader) {
+	pr, pw := io.Pipe()
+	return &streamTarget{
+		host:   host,
+		chunks: make(chan []byte, queueLength),
+		writer: pw,
+		done:   make(chan struct{}),
+	}, pr
+}
+
+func (st *streamTarget) isDropped() bool {
+	return atomic.LoadInt32(&st.dropped) == 1
+}
+
+func (st *streamTarget) drop(err error) {
+	atomic.StoreInt32(&st.dropped, 1)
+	closeErr := st.writer.CloseWithError(err)
+	if closeErr != nil {
+		log.Debugf("Could not close body pipe for %s: %s", st.host, closeErr)
+	}
+}
+
+// pump writes queued chunks into backend pipe. Once pipe write fails
+// (backend closed body) rest of chunks are discarded.
+func (st *streamTarget) pump() {
+	defer close(st.done)
+	for chunk := range st.chunks {
+		if st.isDropped() {
+			continue
+		}
+		if _, err := st.writer.Write(chunk); err != nil {
+			atomic.StoreInt32(&st.dropped, 1)
+		}
+	}
+}
+
+// finish closes backend pipe once all queued chunks are written
+func (st *streamTarget) finish(err error) {
+	close(st.chunks)
+	<-st.done
+	closeErr := st.writer.CloseWithError(err)
+	if closeErr != nil {
+		log.Debugf("Could not close body pipe for %s: %s", st.host, closeErr)
+	}
+}
+
+// fanOut reads single source and feeds all targets
+type fanOut struct {
+	conf    *BodyStreaming
+	targets []*streamTarget
+	reqID   interface{}
+}
+
+func (fo *fanOut) dispatch(chunk []byte) {
+	for _, target := range fo.targets {
+		if target.isDropped() {
+			continue
+		}
+		select {
+		case target.chunks <- chunk:
+			continue
+		default:
+		}
+		timer := time.NewTimer(fo.conf.slowBackendTimeout())
+		select {
+		case target.chunks <- chunk:
+			timer.Stop()
+		case <-timer.C:
+			log.Printf("Backend %s dropped from request %s body streaming, too slow", target.host, fo.reqID)
+			target.drop(ErrSlowBackend)
+		}
+	}
+}
+
+func (fo *fanOut) allDropped() bool {
+	for _, target := range fo.targets {
+		if !target.isDropped() {
+			return false
+		}
+	}
+	return true
+}
+
+// run copies src into all targets. If declared length is not negative
+// and src ends before, all targets get ErrBodyContentLengthMismatch.
+func (fo *fanOut) run(src io.Reader, declaredLength int64, cancelFun func()) {
+	for _, target := range fo.targets {
+		go target.pump()
+	}
+	var total int64
+	var readErr error
+	for !fo.allDropped() {
+		buf := make([]byte, fo.conf.chunkSize())
+		n, err := src.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			fo.dispatch(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	if readErr == nil && declaredLength >= 0 && total < declaredLength && !fo.allDropped() {
+		readErr = ErrBodyContentLengthMismatch
+	}
+	if readErr != nil {
+		log.Debugf("Body streaming for request %s failed: %s", fo.reqID, readErr)
+		cancelFun()
+	}
+	for _, target := range fo.targets {
+		go target.finish(readErr)
+	}
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/allegro/akubra/metrics"
+)
+
+// withClientTrace returns context recording connection phases of backend
+// requests as reqs.backend.<host>.* timers: dns, connect, tls_handshake,
+// got_conn.reused, got_conn.new and first_byte. Connection and first byte
+// times are measured from start of every attempt.
+func withClientTrace(ctx context.Context, host string) context.Context {
+	prefix := "reqs.backend." + metrics.Clean(host) + "."
+	mx := sync.Mutex{}
+	var attemptStart, dnsStart, tlsStart time.Time
+	connectStarts := make(map[string]time.Time)
+	started := func(at *time.Time) {
+		mx.Lock()
+		*at = time.Now()
+		mx.Unlock()
+	}
+	since := func(at *time.Time) time.Time {
+		mx.Lock()
+		defer mx.Unlock()
+		return *at
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			started(&attemptStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				metrics.UpdateSince(prefix+"got_conn.reused", since(&attemptStart))
+				return
+			}
+			metrics.UpdateSince(prefix+"got_conn.new", since(&attemptStart))
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			started(&dnsStart)
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err == nil {
+				metrics.UpdateSince(prefix+"dns", since(&dnsStart))
+			}
+		},
+		// dialer may connect to several addresses in parallel
+		ConnectStart: func(network, addr string) {
+			mx.Lock()
+			connectStarts[addr] = time.Now()
+			mx.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mx.Lock()
+			start, ok := connectStarts[addr]
+			mx.Unlock()
+			if ok && err == nil {
+				metrics.UpdateSince(prefix+"connect", start)
+			}
+		},
+		TLSHandshakeStart: func() {
+			started(&tlsStart)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err == nil {
+				metrics.UpdateSince(prefix+"tls_handshake", since(&tlsStart))
+			}
+		},
+		GotFirstResponseByte: func() {
+			metrics.UpdateSince(prefix+"first_byte", since(&attemptStart))
+		},
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/allegro/akubra/metrics"
+	gometrics "github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func timerCount(name string) int64 {
+	timer, ok := gometrics.DefaultRegistry.Get(name).(gometrics.Timer)
+	if !ok {
+		return 0
+	}
+	return timer.Count()
+}
+
+func TestBackendConnectionPhasesAreTraced(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer ts.Close()
+	backend, err := url.Parse(ts.URL)
+	require.NoError(t, err)
+	transp := mkTransportWithRoundTripper([]url.URL{*backend}, &http.Transport{}, t)
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/bucket/key", nil)
+		resp, err := transp.RoundTrip(req)
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	prefix := "reqs.backend." + metrics.Clean(backend.Host) + "."
+	assert.Equal(t, int64(1), timerCount(prefix+"connect"))
+	assert.Equal(t, int64(1), timerCount(prefix+"got_conn.new"))
+	assert.Equal(t, int64(1), timerCount(prefix+"got_conn.reused"))
+	assert.Equal(t, int64(2), timerCount(prefix+"first_byte"))
+}
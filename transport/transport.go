@@ -146,19 +146,68 @@ type MultiTransport struct {
 	HandleResponses MultipleResponsesHandler
 	// Process request between replication and sending, useful for changing request headers
 	PreProcessRequest RequestProcessor
+	// Streaming enables fan-out body streaming, if nil request body
+	// is buffered in memory before it's sent to backends
+	Streaming *BodyStreaming
+	// Breakers stop sending requests to failing backends, disabled if nil
+	Breakers *CircuitBreakers
+	// Health stops sending requests to backends failing health checks,
+	// disabled if nil
+	Health *HealthChecker
+	// ReadPolicy if set, GET and HEAD requests are sent to single backend
+	// with failover to next ones, instead of all backends
+	ReadPolicy ReadPolicy
+	// Hedging if set, GET requests are sent to single backend and
+	// repeated on second one if first is slow
+	Hedging *HedgedReads
+	// Retries repeats idempotent requests failed on backend, disabled if nil
+	Retries *RetryPolicy
+	// Spill buffers large request bodies in temporary files instead of
+	// memory, disabled if nil
+	Spill *BodySpill
+	// Bulkheads fail requests to backends with too many requests in
+	// progress, disabled if nil
+	Bulkheads *Bulkheads
+	// Async acknowledges writes after first backend succeeds and
+	// replicates them to other backends in background, disabled if nil
+	Async *AsyncReplication
+	// Multipart maps client multipart upload ids to upload ids of
+	// backends, uploads are passed unchanged if nil
+	Multipart *MultipartUploads
 }
 
 // ReplicateRequests creates request copies (one per MultiTransport.Bakcends item).
 // New requests will have substituted Host field, original request body will be copied
 // simultaneously
 func (mt *MultiTransport) ReplicateRequests(req *http.Request, cancelFun context.CancelFunc) (reqs []*http.Request, err error) {
+	reqs, release, err := mt.replicateRequests(req, cancelFun)
+	release()
+	return reqs, err
+}
+
+// replicateRequests works like ReplicateRequests, returned release function
+// has to be called once all requests are sent
+func (mt *MultiTransport) replicateRequests(req *http.Request, cancelFun context.CancelFunc) ([]*http.Request, func(), error) {
+	noRelease := func() {}
+	if mt.Streaming != nil && req.ContentLength != 0 {
+		reqs, err := mt.streamRequests(req, cancelFun)
+		return reqs, noRelease, err
+	}
+	if mt.Spill != nil && (req.ContentLength > mt.Spill.Threshold || req.ContentLength < 0) {
+		return mt.spillRequests(req, cancelFun)
+	}
+	reqs, err := mt.bufferRequests(req, cancelFun)
+	return reqs, noRelease, err
+}
+
+// bufferRequests creates request copies which bodies are read from
+// in memory buffer
+func (mt *MultiTransport) bufferRequests(req *http.Request, cancelFun context.CancelFunc) (reqs []*http.Request, err error) {
 	copiesCount := len(mt.Backends)
 	reqs = make([]*http.Request, 0, copiesCount)
 	// We need some read closers
 	bodyBuffer := &bytes.Buffer{}
-	bodyReader := &TimeoutReader{
-		io.LimitReader(req.Body, req.ContentLength),
-		time.Second}
+	bodyReader := clientBodyReader(req)
 
 	n, cerr := io.Copy(bodyBuffer, bodyReader)
 
@@ -168,35 +217,133 @@ func (mt *MultiTransport) ReplicateRequests(req *http.Request, cancelFun context
 	}
 
 	for _, backend := range mt.Backends {
-		req.URL.Host = backend.Host
-		log.Debugf("Replicate request %s, for %s", req.Context().Value(log.ContextreqIDKey), backend.Host)
-
 		bodyContent := bodyBuffer.Bytes()
 		var newBody io.Reader
 		if len(bodyContent) > 0 {
-			newBody = ioutil.NopCloser(bytes.NewReader(bodyContent))
+			// bytes.Reader lets http.NewRequest set GetBody, so request
+			// can be retried
+			newBody = bytes.NewReader(bodyContent)
 		}
-		r, rerr := http.NewRequest(req.Method, req.URL.String(), newBody)
-		// Copy request data
+		r, rerr := newBackendRequest(req, backend, newBody, int64(bodyBuffer.Len()))
 		if rerr != nil {
 			return nil, rerr
 		}
-		r.Header = make(http.Header, len(req.Header))
-		for k, v := range req.Header {
-			r.Header[k] = make([]string, len(v))
-			copy(r.Header[k], v)
-		}
-		r.ContentLength = int64(bodyBuffer.Len())
-		r.TransferEncoding = req.TransferEncoding
 		reqs = append(reqs, r)
 	}
 
 	return reqs, err
 }
 
+// spillRequests creates request copies which bodies are read from
+// temporary file, see BodySpill
+func (mt *MultiTransport) spillRequests(req *http.Request, cancelFun context.CancelFunc) ([]*http.Request, func(), error) {
+	noRelease := func() {}
+	bodyReader := clientBodyReader(req)
+	spilled, err := mt.Spill.spill(bodyReader, req.ContentLength)
+	if err != nil {
+		cancelFun()
+		return nil, noRelease, err
+	}
+	reqs := make([]*http.Request, 0, len(mt.Backends))
+	for _, backend := range mt.Backends {
+		var r *http.Request
+		body, rerr := spilled.reader()
+		if rerr == nil {
+			r, rerr = newBackendRequest(req, backend, body, spilled.size)
+			if rerr != nil {
+				if closeErr := body.Close(); closeErr != nil {
+					log.Debugf("Could not close request body %s", closeErr)
+				}
+			}
+		}
+		if rerr != nil {
+			for _, created := range reqs {
+				closeRequestBody(created)
+			}
+			spilled.release()
+			return nil, noRelease, rerr
+		}
+		r.GetBody = spilled.reader
+		reqs = append(reqs, r)
+	}
+	return reqs, spilled.release, nil
+}
+
+// streamRequests creates request copies which bodies are fed by single
+// client body reader, see BodyStreaming
+func (mt *MultiTransport) streamRequests(req *http.Request, cancelFun context.CancelFunc) ([]*http.Request, error) {
+	reqs := make([]*http.Request, 0, len(mt.Backends))
+	fo := &fanOut{
+		conf:    mt.Streaming,
+		targets: make([]*streamTarget, 0, len(mt.Backends)),
+		reqID:   req.Context().Value(log.ContextreqIDKey),
+	}
+	for _, backend := range mt.Backends {
+		target, bodyPipe := newStreamTarget(backend.Host, mt.Streaming.queueLength())
+		r, rerr := newBackendRequest(req, backend, bodyPipe, req.ContentLength)
+		if rerr != nil {
+			return nil, rerr
+		}
+		fo.targets = append(fo.targets, target)
+		reqs = append(reqs, r)
+	}
+	bodyReader := clientBodyReader(req)
+	go fo.run(bodyReader, req.ContentLength, cancelFun)
+	return reqs, nil
+}
+
+// clientBodyReader returns client request body reader, limited to
+// ContentLength if it's known
+func clientBodyReader(req *http.Request) io.Reader {
+	if req.Body == nil {
+		return &bytes.Reader{}
+	}
+	var body io.Reader = req.Body
+	if req.ContentLength >= 0 {
+		body = io.LimitReader(req.Body, req.ContentLength)
+	}
+	return &TimeoutReader{body, time.Second}
+}
+
+// newBackendRequest copies request data into new request targeted at backend
+func newBackendRequest(req *http.Request, backend url.URL, body io.Reader, contentLength int64) (*http.Request, error) {
+	req.URL.Host = backend.Host
+	req.URL.Scheme = backend.Scheme
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "http"
+	}
+	log.Debugf("Replicate request %s, for %s", req.Context().Value(log.ContextreqIDKey), backend.Host)
+	r, err := http.NewRequest(req.Method, req.URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = make([]string, len(v))
+		copy(r.Header[k], v)
+	}
+	// Host header is not sent by client, it's set by processors to
+	// override request Host
+	if host := req.Header.Get("Host"); host != "" {
+		r.Host = host
+	}
+	r.ContentLength = contentLength
+	// body of unknown length is forwarded chunked, otherwise
+	// Content-Length is sent
+	if contentLength < 0 {
+		r.TransferEncoding = req.TransferEncoding
+	}
+	return r, nil
+}
+
 func collectMetrics(req *http.Request, reqresperr ReqResErrTuple, since time.Time) {
 	host := metrics.Clean(req.URL.Host)
 	metrics.UpdateSince("reqs.backend."+host+".all", since)
+	if reqresperr.Res != nil {
+		backendLatencies.Observe(req.URL.Host, time.Since(since))
+	} else if reqresperr.Err != nil && reqresperr.Err != ErrBodyContentLengthMismatch && reqresperr.Err != context.Canceled {
+		backendLatencies.observeFailure(req.URL.Host, time.Since(since))
+	}
 	if reqresperr.Err != nil {
 		metrics.UpdateSince("reqs.backend."+host+".err", since)
 	}
@@ -215,55 +362,140 @@ func (mt *MultiTransport) sendRequest(
 	out chan ReqResErrTuple) {
 	since := time.Now()
 	ctx := req.Context()
-	o := make(chan ReqResErrTuple)
+	o := make(chan ReqResErrTuple, 1)
 	go func() {
-		if mt.SkipBackends[req.URL.Host] {
-			log.Debugf("Skipping request %s, for %s", req.Context().Value(log.ContextreqIDKey), req.URL.Host)
-			r := ReqResErrTuple{req, nil, fmt.Errorf("Maintained Backend %s", req.URL.Host), true}
-			o <- r
-			return
-		}
-
-		resp, err := mt.RoundTripper.RoundTrip(req.WithContext(context.Background()))
-		// report Non 2XX status codes as errors
-		if err != nil {
-			log.Debugf("Send request error %s, %s", err.Error(), ctx.Value(log.ContextreqIDKey))
-		}
-		failed := err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
-		r := ReqResErrTuple{req, resp, err, failed}
-		o <- r
+		o <- mt.doRequest(req, context.Background())
 	}()
 	var reqresperr ReqResErrTuple
-	defer collectMetrics(req, reqresperr, since)
 
 	select {
 	case <-ctx.Done():
 		log.Debugf("Ctx Done reqID %s ", ctx.Value(log.ContextreqIDKey))
 		reqresperr = ReqResErrTuple{req, nil, ErrBodyContentLengthMismatch, true}
+		// metrics are collected from backend result, response arriving
+		// later has to be closed, it holds connection and bulkhead slot
+		go func() {
+			late := <-o
+			collectMetrics(req, late, since)
+			discardResponse(late.Res)
+		}()
 	case reqresperr = <-o:
-		break
+		collectMetrics(req, reqresperr, since)
 	}
 	out <- reqresperr
 }
 
+// doRequest sends request to backend unless backend is skipped, roundtrip
+// is bound to rtCtx
+func (mt *MultiTransport) doRequest(req *http.Request, rtCtx context.Context) ReqResErrTuple {
+	since := time.Now()
+	ctx := req.Context()
+	if mt.SkipBackends[req.URL.Host] {
+		log.Debugf("Skipping request %s, for %s", ctx.Value(log.ContextreqIDKey), req.URL.Host)
+		closeRequestBody(req)
+		return ReqResErrTuple{req, nil, fmt.Errorf("Maintained Backend %s", req.URL.Host), true}
+	}
+
+	if mt.Health != nil && !mt.Health.Available(req.URL.Host) {
+		log.Debugf("Backend unavailable, skipping request %s, for %s", ctx.Value(log.ContextreqIDKey), req.URL.Host)
+		closeRequestBody(req)
+		return ReqResErrTuple{req, nil, ErrBackendUnavailable, true}
+	}
+
+	if mt.Bulkheads != nil {
+		if !mt.Bulkheads.Acquire(req.URL.Host) {
+			log.Debugf("Too many requests in progress, skipping request %s, for %s", ctx.Value(log.ContextreqIDKey), req.URL.Host)
+			closeRequestBody(req)
+			return ReqResErrTuple{req, nil, ErrBulkheadFull, true}
+		}
+	}
+
+	var breaker *CircuitBreaker
+	if mt.Breakers != nil {
+		breaker = mt.Breakers.Get(req.URL.Host)
+		if !breaker.Allow() {
+			log.Debugf("Circuit open, skipping request %s, for %s", ctx.Value(log.ContextreqIDKey), req.URL.Host)
+			closeRequestBody(req)
+			if mt.Bulkheads != nil {
+				mt.Bulkheads.Release(req.URL.Host)
+			}
+			return ReqResErrTuple{req, nil, ErrCircuitOpen, true}
+		}
+	}
+
+	resp, err := mt.roundTripWithRetries(req, withClientTrace(rtCtx, req.URL.Host))
+	if err != nil && rtCtx.Err() == context.Canceled {
+		// request abandoned by akubra, e.g. losing hedged read, says
+		// nothing about backend health
+		err = context.Canceled
+	}
+	if mt.Bulkheads != nil {
+		mt.Bulkheads.holdUntilBodyRead(req.URL.Host, resp)
+	}
+	if breaker != nil && err == context.Canceled {
+		breaker.Cancel()
+	} else if breaker != nil {
+		breaker.Record(err == nil && resp.StatusCode < 500, time.Since(since))
+	}
+	// report Non 2XX status codes as errors
+	if err != nil {
+		log.Debugf("Send request error %s, %s", err.Error(), ctx.Value(log.ContextreqIDKey))
+	}
+	failed := err != nil || resp != nil && (resp.StatusCode < 200 || resp.StatusCode > 399)
+	return ReqResErrTuple{req, resp, err, failed}
+}
+
+// closeRequestBody releases body of request which will not be sent,
+// streamed body would block other backends otherwise
+func closeRequestBody(req *http.Request) {
+	if req.Body == nil {
+		return
+	}
+	if err := req.Body.Close(); err != nil {
+		log.Debugf("Could not close request body %s", err)
+	}
+}
+
 // RoundTrip satisfies http.RoundTripper interface
 func (mt *MultiTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	if mt.Multipart != nil && isMultipartRequest(req) {
+		return mt.multipartRoundTrip(req)
+	}
+	if mt.Hedging != nil && req.Method == http.MethodGet {
+		rctx := backendContext(context.Background(), req)
+		return mt.hedgedRead(req, rctx)
+	}
+	if mt.ReadPolicy != nil && isSingleBackendRead(req) {
+		rctx := backendContext(context.Background(), req)
+		return mt.readWithFailover(req, rctx)
+	}
+	if mt.Async != nil && isAsyncReplicable(req) {
+		rctx := backendContext(context.Background(), req)
+		return mt.asyncWrite(req, rctx)
+	}
 	bctx, cancelFunc := context.WithCancel(context.Background())
-	bctx = context.WithValue(bctx, log.ContextreqIDKey, req.Context().Value(log.ContextreqIDKey))
-	reqs, err := mt.ReplicateRequests(req, cancelFunc)
+	bctx = backendContext(bctx, req)
+	reqs, release, err := mt.replicateRequests(req, cancelFunc)
 	if err != nil {
 		return nil, err
 	}
+	mt.preProcess(req, reqs...)
+	return mt.sendAll(reqs, bctx, release, mt.HandleResponses)
+}
 
+// sendAll sends requests in parallel and passes responses to handle,
+// release is called once all responses come in
+func (mt *MultiTransport) sendAll(reqs []*http.Request, ctx context.Context, release func(), handle MultipleResponsesHandler) (*http.Response, error) {
 	c := make(chan ReqResErrTuple, len(reqs))
 	if len(reqs) == 0 {
+		release()
 		return nil, errors.New("No requests provided")
 	}
 
 	wg := sync.WaitGroup{}
 	for _, req := range reqs {
 		wg.Add(1)
-		r := req.WithContext(bctx)
+		r := req.WithContext(ctx)
 		go func() {
 			mt.sendRequest(r, c)
 			wg.Done()
@@ -273,8 +505,51 @@ func (mt *MultiTransport) RoundTrip(req *http.Request) (resp *http.Response, err
 	// close c chanel once all requests comes in
 	go func() {
 		wg.Wait()
+		release()
 		close(c)
 	}()
+	resTup := handle(c)
+	return resTup.Res, resTup.Err
+}
+
+// backendContext carries client request context values over to context
+// of backend requests
+func backendContext(parent context.Context, req *http.Request) context.Context {
+	ctx := context.WithValue(parent, log.ContextreqIDKey, req.Context().Value(log.ContextreqIDKey))
+	return context.WithValue(ctx, log.ContextRetriesKey, req.Context().Value(log.ContextRetriesKey))
+}
+
+// readWithFailover sends request to backends one by one, in ReadPolicy
+// order, until one of them responds with neither error nor 404
+func (mt *MultiTransport) readWithFailover(req *http.Request, ctx context.Context) (*http.Response, error) {
+	backends := mt.ReadPolicy.Order(mt.Backends)
+	if len(backends) == 0 {
+		return nil, errors.New("No requests provided")
+	}
+	reqs := make([]*http.Request, 0, len(backends))
+	for _, backend := range backends {
+		r, err := newBackendRequest(req, backend, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, r.WithContext(ctx))
+	}
+	mt.preProcess(req, reqs...)
+
+	c := make(chan ReqResErrTuple, len(reqs))
+	go func() {
+		defer close(c)
+		for _, r := range reqs {
+			attempt := make(chan ReqResErrTuple, 1)
+			mt.sendRequest(r, attempt)
+			tup := <-attempt
+			c <- tup
+			if !needsFailover(tup) {
+				return
+			}
+			log.Debugf("Read request %s failed on %s, trying next backend", ctx.Value(log.ContextreqIDKey), r.URL.Host)
+		}
+	}()
 	resTup := mt.HandleResponses(c)
 	return resTup.Res, resTup.Err
 }
@@ -302,3 +577,18 @@ func NewMultiTransport(roundTripper http.RoundTripper,
 		SkipBackends:    mb,
 		HandleResponses: responsesHandler}
 }
+
+// HostRoundTripper sends requests with round tripper selected by request
+// URL host, Default is used for other hosts
+type HostRoundTripper struct {
+	Default http.RoundTripper
+	Hosts   map[string]http.RoundTripper
+}
+
+// RoundTrip satisfies http.RoundTripper interface
+func (hrt *HostRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt, ok := hrt.Hosts[req.URL.Host]; ok {
+		return rt.RoundTrip(req)
+	}
+	return hrt.Default.RoundTrip(req)
+}
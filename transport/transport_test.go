@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -140,3 +142,83 @@ func TestRequestMultiplication(t *testing.T) {
 		t.Errorf("Should get ErrTimeout or ErrBodyContentLengthMismatch")
 	}
 }
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (rtf roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return rtf(req)
+}
+
+func TestStreamingRequestMultiplication(t *testing.T) {
+	stream := []byte("zażółć gęślą jaźń")
+	urls := mkDummySrvs(3, stream, t)
+	transp := mkTransport(urls, t)
+	transp.Streaming = &BodyStreaming{ChunkSize: 4, QueueLength: 2}
+	_, err := transp.RoundTrip(dummyReq(stream, 0))
+	require.NoError(t, err)
+	_, err = transp.RoundTrip(dummyReq(stream, 1))
+	require.Error(t, err, "Should get ErrBodyContentLengthMismatch")
+}
+
+func TestStreamingDropsSlowBackend(t *testing.T) {
+	stream := []byte("some longer body content")
+	urls := []url.URL{{Scheme: "http", Host: "fast"}, {Scheme: "http", Host: "slow"}}
+	bodies := make(chan []byte, 1)
+	slowErrs := make(chan error, 1)
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Host == "slow" {
+			<-time.After(200 * time.Millisecond)
+			_, err := ioutil.ReadAll(req.Body)
+			slowErrs <- err
+			return nil, err
+		}
+		b, err := ioutil.ReadAll(req.Body)
+		bodies <- b
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewReader([]byte("OK")))}, err
+	})
+	transp := mkTransportWithRoundTripper(urls, rt, t)
+	transp.Streaming = &BodyStreaming{ChunkSize: 1, QueueLength: 1, SlowBackendTimeout: 10 * time.Millisecond}
+	resp, err := transp.RoundTrip(dummyReq(stream, 0))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, stream, <-bodies)
+	require.Equal(t, ErrSlowBackend, <-slowErrs)
+}
+
+func mkChunkedRequest(body string) *http.Request {
+	req, _ := http.NewRequest("PUT", "http://example.com/bucket/key", ioutil.NopCloser(bytes.NewBufferString(body)))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	return req
+}
+
+func TestChunkedBodyIsBufferedWithContentLength(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "chunked content", string(b))
+		assert.Equal(t, int64(len(b)), req.ContentLength)
+		assert.Empty(t, req.TransferEncoding)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), rt, t)
+	resp, err := transp.RoundTrip(mkChunkedRequest("chunked content"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestChunkedBodyIsStreamedChunked(t *testing.T) {
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		b, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "chunked content", string(b))
+		assert.Equal(t, int64(-1), req.ContentLength)
+		assert.Equal(t, []string{"chunked"}, req.TransferEncoding)
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	transp := mkTransportWithRoundTripper(mkBackends("a", "b"), rt, t)
+	transp.Streaming = &BodyStreaming{ChunkSize: 4}
+	resp, err := transp.RoundTrip(mkChunkedRequest("chunked content"))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}